@@ -0,0 +1,192 @@
+package pgrpc
+
+import (
+	"net"
+	"path"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// reason of a RejectEvent
+const (
+	RejectSource   = "source"    // source network is not allowed
+	RejectIDSource = "id_source" // id is not allowed from the source network
+)
+
+// RejectEvent is a registration attempt rejected by the client
+type RejectEvent struct {
+	Time   time.Time
+	Addr   net.Addr // source of the conn, after PROXY protocol resolution
+	ID     string   // empty if the conn is rejected before reading hello
+	Reason string
+}
+
+// ClientStats is the metrics of a Client
+type ClientStats struct {
+	Conns      int               // conns from servers
+	Handshakes int               // conns in handshake
+	Rejected   map[string]uint64 // rejected attempts by reason
+	Denied     uint64            // calls denied by WithAuthz
+}
+
+// idSource allow ids matching pattern only from nets
+type idSource struct {
+	pattern string
+	nets    []*net.IPNet
+}
+
+type sourceAllow struct {
+	pattern string
+	addrs   []string
+	perID   bool
+}
+
+// WithSourceAllow only accept conns from the IPs or CIDRs, eg: "10.0.0.0/8".
+// The source is evaluated after accept hooks, so it is the PROXY protocol
+// source with WithProxyProtocol. It may be set multiple times, all sources
+// are allowed by default.
+func WithSourceAllow(addrs ...string) ClientOpt {
+	return &sourceAllow{addrs: addrs}
+}
+
+// WithIDSourceAllow only accept the ids matching pattern from the IPs or
+// CIDRs, eg: WithIDSourceAllow("store-*", "10.20.0.0/16"). The pattern is of
+// path.Match, an id matching several patterns is allowed from the sources of
+// any of them, ids matching none are only checked by WithSourceAllow.
+func WithIDSourceAllow(pattern string, addrs ...string) ClientOpt {
+	return &sourceAllow{pattern: pattern, addrs: addrs, perID: true}
+}
+func (o *sourceAllow) applyClient(co *clientOpts) {
+	nets, err := parseNets(o.addrs)
+	if err != nil {
+		co.err = err
+		return
+	}
+
+	if !o.perID {
+		co.allowSources = append(co.allowSources, nets...)
+		if co.allowSources == nil { // allow nothing, rather than all
+			co.allowSources = []*net.IPNet{}
+		}
+		return
+	}
+
+	if _, err := path.Match(o.pattern, ""); err != nil {
+		co.err = errors.Wrapf(err, "invalid id pattern %q", o.pattern)
+		return
+	}
+	co.idSources = append(co.idSources, idSource{pattern: o.pattern, nets: nets})
+}
+
+type rejectHook struct {
+	fn func(*RejectEvent)
+}
+
+// WithRejectHook call fn on every rejected registration attempt, fn should
+// not block
+func WithRejectHook(fn func(*RejectEvent)) ClientOpt {
+	return &rejectHook{fn: fn}
+}
+func (o *rejectHook) applyClient(co *clientOpts) {
+	co.onReject = append(co.onReject, o.fn)
+}
+
+// allowSource report whether conns from addr are allowed, by both the options
+// and the credentials
+func (co *clientOpts) allowSource(addr net.Addr) bool {
+	if co.creds != nil && !co.creds.allowSource(addrIP(addr)) {
+		return false
+	}
+	return co.allowSources == nil || netsContain(co.allowSources, addrIP(addr))
+}
+
+// allowID report whether id is allowed to register from addr
+func (co *clientOpts) allowID(id string, addr net.Addr) bool {
+	matched := false
+	for _, rule := range co.idSources {
+		if ok, _ := path.Match(rule.pattern, id); !ok {
+			continue
+		}
+		if netsContain(rule.nets, addrIP(addr)) {
+			return true
+		}
+		matched = true
+	}
+	return !matched
+}
+
+// admit check the registration of hello from the conn against the limits,
+// source rules, noise key and token, disallowed ids are removed. A *rejectError is returned
+// if the conn is rejected.
+func (c *Client) admit(conn net.Conn, h *hello) error {
+	addr := conn.RemoteAddr()
+	if err := c.admitConn(addr, h); err != nil {
+		return err
+	}
+	if err := c.admitIDs(addr, h); err != nil {
+		return err
+	}
+	return c.admitIdle(addr, h)
+}
+
+// admitIDs remove the ids of hello not allowed from addr by the source rules,
+// noise key and token
+func (c *Client) admitIDs(addr net.Addr, h *hello) error {
+	ids := h.IDs[:0]
+	for _, id := range h.IDs {
+		if c.allowID(id, addr) {
+			ids = append(ids, id)
+		} else {
+			c.reject(addr, id, RejectIDSource)
+		}
+	}
+	h.IDs = ids
+	if len(ids) == 0 {
+		return &rejectError{reason: RejectIDSource, backoff: c.backoff()}
+	}
+
+	if h.noisePeer != nil {
+		if err := c.admitNoise(addr, h); err != nil {
+			return err
+		}
+	}
+	if c.tokenVerifier != nil {
+		return c.admitToken(addr, h)
+	}
+	return nil
+}
+
+// reject count a rejected attempt and report it to the hooks
+func (c *Client) reject(addr net.Addr, id, reason string) {
+	c.statsMu.Lock()
+	c.rejected[reason]++
+	c.statsMu.Unlock()
+
+	c.Log("reject %s from %s: %s", id, addr, reason)
+	if len(c.onReject) == 0 {
+		return
+	}
+
+	event := &RejectEvent{Time: time.Now(), Addr: addr, ID: id, Reason: reason}
+	for _, fn := range c.onReject {
+		fn(event)
+	}
+}
+
+// Stats return the metrics of the client
+func (c *Client) Stats() ClientStats {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+
+	stats := ClientStats{
+		Conns:      c.conns,
+		Handshakes: c.handshakes,
+		Denied:     c.denied,
+		Rejected:   make(map[string]uint64, len(c.rejected)),
+	}
+	for reason, n := range c.rejected {
+		stats.Rejected[reason] = n
+	}
+	return stats
+}
@@ -0,0 +1,103 @@
+package pgrpc_test
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wweir/pgrpc"
+)
+
+// listenFrom register ids on the client at addr from source, told by a PROXY
+// header the client trusts
+func listenFrom(t *testing.T, addr, source string, ids ...string) *pgrpc.Session {
+	t.Helper()
+	sess, err := pgrpc.NewSession(addr, pgrpc.WithIdlePool(0, 1),
+		pgrpc.WithProxyHeader(&pgrpc.ProxyHeader{Source: &net.TCPAddr{IP: net.ParseIP(source), Port: 1000}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids {
+		ln, err := sess.Listen(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go serveEcho(ln)
+	}
+	return sess
+}
+
+func Test_SourceAllow(t *testing.T) {
+	mu := sync.Mutex{}
+	events := map[string]bool{}
+	c, addr := newClient(t, pgrpc.WithProxyProtocol(),
+		pgrpc.WithSourceAllow("10.0.0.0/8", "192.168.1.1"),
+		pgrpc.WithIDSourceAllow("store-*", "10.20.0.0/16"),
+		pgrpc.WithIDSourceAllow("store-*", "10.30.0.1"),
+		pgrpc.WithIDSourceAllow("admin", "10.40.0.0/16"),
+		pgrpc.WithRejectHook(func(e *pgrpc.RejectEvent) {
+			ip, _, _ := net.SplitHostPort(e.Addr.String())
+			mu.Lock()
+			events[ip+" "+e.ID+" "+e.Reason] = true
+			mu.Unlock()
+		}))
+
+	for source, ids := range map[string][]string{
+		"10.20.1.1":   {"store-1", "web-1"},
+		"10.30.0.1":   {"store-2", "admin"},
+		"10.1.1.1":    {"store-3", "admin"},
+		"192.168.1.1": {"web-2"},
+		"192.168.1.2": {"web-3"},
+	} {
+		defer listenFrom(t, addr, source, ids...).Close()
+	}
+
+	for _, id := range []string{"store-1", "web-1", "store-2", "web-2"} {
+		waitServer(t, c, id)
+	}
+	want := []string{
+		"10.30.0.1 admin id_source",
+		"10.1.1.1 store-3 id_source",
+		"10.1.1.1 admin id_source",
+		"192.168.1.2  source",
+	}
+	waitFor(t, "the rejections", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, event := range want {
+			if !events[event] {
+				return false
+			}
+		}
+		return true
+	})
+	for _, id := range []string{"store-3", "admin", "web-3"} {
+		if servers := c.Servers(id); len(servers) != 0 {
+			t.Errorf("%s registered: %+v", id, servers)
+		}
+	}
+	if stats := c.Stats(); stats.Rejected[pgrpc.RejectIDSource] < 3 || stats.Rejected[pgrpc.RejectSource] < 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+
+	// the admitted id of a Session with a rejected one is served
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := c.DialConn(ctx, "store-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	echo(t, conn, "hello from 10.30.0.1")
+
+	for _, opt := range []pgrpc.ClientOpt{
+		pgrpc.WithSourceAllow("10.0.0.0/33"),
+		pgrpc.WithIDSourceAllow("[store", "10.0.0.0/8"),
+	} {
+		if _, err := pgrpc.NewClient("127.0.0.1:0", opt); err == nil {
+			t.Errorf("invalid option %#v accepted", opt)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package pgrpc
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"path"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	grpccreds "google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// ErrUnauthorized is the cause of the errors of calls denied by WithAuthz
+var ErrUnauthorized = errors.New("pgrpc: unauthorized")
+
+// AuthzRule allow or deny the matched callers to reach servers, an empty field
+// matches any. Patterns are of path.Match.
+type AuthzRule struct {
+	Callers []string          // patterns of caller identities, "" matches calls without identity
+	IDs     []string          // patterns of server ids
+	Labels  map[string]string // labels all the servers of the id should have, see Client.Servers
+	Methods []string          // patterns of grpc methods, eg: "/pkg.Service/*", raw conns have no method
+	Deny    bool
+}
+
+// AuthzPolicy decide whether a caller may reach a server by the first matched
+// rule, it is denied if none matches. The identity of a caller is the one set
+// by ContextWithCaller, or the verified tls CommonName of the incoming grpc
+// peer, or the CallerHeader of the incoming grpc metadata. Conns proxied by
+// Forward and ServeSOCKS5 are called by their tls CommonName or source ip.
+type AuthzPolicy struct {
+	Rules        []AuthzRule
+	CallerHeader string // incoming grpc metadata of the caller identity, eg: set by a trusted proxy
+
+	// Audit is called on every denied decision, the decisions are logged if
+	// nil. It should not block.
+	Audit func(*AuthzDecision)
+}
+
+// AuthzDecision is the authorization of a call
+type AuthzDecision struct {
+	Time    time.Time
+	Caller  string
+	ID      string
+	Method  string // empty for raw conns
+	Rule    int    // index of the matched rule, -1 if none
+	Allowed bool
+}
+
+type authz struct {
+	policy AuthzPolicy
+}
+
+// WithAuthz authorize the callers of the client to reach servers, on Dial,
+// DialConn and the proxying of Forward, ServeSOCKS5 and HTTPTransport. grpc
+// calls are checked per method on the ClientConns of Dial and Each.
+func WithAuthz(policy AuthzPolicy) ClientOpt {
+	return &authz{policy: policy}
+}
+func (o *authz) applyClient(co *clientOpts) {
+	for _, rule := range o.policy.Rules {
+		for _, patterns := range [][]string{rule.Callers, rule.IDs, rule.Methods} {
+			for _, pattern := range patterns {
+				if _, err := path.Match(pattern, ""); err != nil {
+					co.err = errors.Wrapf(err, "invalid authz pattern %q", pattern)
+					return
+				}
+			}
+		}
+	}
+
+	policy := o.policy
+	co.authz = &policy
+}
+
+type callerKey struct{}
+
+// ContextWithCaller set the identity of the caller of ctx, see AuthzPolicy
+func ContextWithCaller(ctx context.Context, identity string) context.Context {
+	return context.WithValue(ctx, callerKey{}, identity)
+}
+
+// callerOf return the identity of the caller of ctx
+func (p *AuthzPolicy) callerOf(ctx context.Context) string {
+	if identity, ok := ctx.Value(callerKey{}).(string); ok {
+		return identity
+	}
+
+	if pr, ok := peer.FromContext(ctx); ok {
+		if info, ok := pr.AuthInfo.(grpccreds.TLSInfo); ok &&
+			len(info.State.VerifiedChains) != 0 && len(info.State.PeerCertificates) != 0 {
+			return info.State.PeerCertificates[0].Subject.CommonName
+		}
+	}
+
+	if p.CallerHeader != "" {
+		if md, ok := metadata.FromIncomingContext(ctx); ok {
+			if vals := md.Get(p.CallerHeader); len(vals) != 0 {
+				return vals[0]
+			}
+		}
+	}
+	return ""
+}
+
+// callerOfConn return the identity of the caller of a proxied conn
+func callerOfConn(conn net.Conn) string {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		if len(state.VerifiedChains) != 0 && len(state.PeerCertificates) != 0 {
+			return state.PeerCertificates[0].Subject.CommonName
+		}
+	}
+	if ip := addrIP(conn.RemoteAddr()); ip != nil {
+		return ip.String()
+	}
+	return conn.RemoteAddr().String()
+}
+
+func matchAny(patterns []string, s string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// match report whether the rule matches the call
+func (r *AuthzRule) match(c *Client, caller, id, method string) bool {
+	if !matchAny(r.Callers, caller) || !matchAny(r.IDs, id) {
+		return false
+	}
+	if len(r.Methods) != 0 && (method == "" || !matchAny(r.Methods, method)) {
+		return false
+	}
+	if len(r.Labels) == 0 {
+		return true
+	}
+
+	servers := c.Servers(id)
+	for _, server := range servers {
+		for k, v := range r.Labels {
+			if server.Labels[k] != v {
+				return false
+			}
+		}
+	}
+	return len(servers) != 0
+}
+
+// authorize check whether the caller of ctx may reach id by method, an error
+// caused by ErrUnauthorized is returned if denied
+func (c *Client) authorize(ctx context.Context, id, method string) error {
+	if c.authz == nil {
+		return nil
+	}
+
+	d := &AuthzDecision{Caller: c.authz.callerOf(ctx), ID: id, Method: method, Rule: -1}
+	for i := range c.authz.Rules {
+		if rule := &c.authz.Rules[i]; rule.match(c, d.Caller, id, method) {
+			d.Rule, d.Allowed = i, !rule.Deny
+			break
+		}
+	}
+	if d.Allowed {
+		return nil
+	}
+
+	c.statsMu.Lock()
+	c.denied++
+	c.statsMu.Unlock()
+
+	d.Time = time.Now()
+	if c.authz.Audit != nil {
+		c.authz.Audit(d)
+	} else {
+		c.Log("authz deny %q to %s%s by rule %d", d.Caller, id, method, d.Rule)
+	}
+	return errors.Wrapf(ErrUnauthorized, "%q to %s%s", d.Caller, id, method)
+}
+
+// authzInterceptors check every grpc call to id
+func (c *Client) authzInterceptors(id string) []grpc.DialOption {
+	unary := func(ctx context.Context, method string, req, reply interface{},
+		cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if err := c.authorize(ctx, id, method); err != nil {
+			return status.Error(codes.PermissionDenied, err.Error())
+		}
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+	stream := func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn,
+		method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		if err := c.authorize(ctx, id, method); err != nil {
+			return nil, status.Error(codes.PermissionDenied, err.Error())
+		}
+		return streamer(ctx, desc, cc, method, opts...)
+	}
+	return []grpc.DialOption{
+		grpc.WithChainUnaryInterceptor(unary),
+		grpc.WithChainStreamInterceptor(stream),
+	}
+}
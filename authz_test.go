@@ -0,0 +1,124 @@
+package pgrpc_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/wweir/pgrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func Test_WithAuthz(t *testing.T) {
+	mu := sync.Mutex{}
+	var decisions []*pgrpc.AuthzDecision
+	c, addr := newClient(t, pgrpc.WithGrpcDialOpt(grpc.WithInsecure()), pgrpc.WithAuthz(pgrpc.AuthzPolicy{
+		Rules: []pgrpc.AuthzRule{
+			{Callers: []string{"ops-*"}, Methods: []string{"/grpc.health.v1.Health/*"}},
+			{IDs: []string{"store-*"}, Methods: []string{"/grpc.health.v1.Health/Watch"}, Deny: true},
+			{Callers: []string{"web"}, IDs: []string{"store-*"}},
+		},
+		CallerHeader: "x-caller",
+		Audit: func(d *pgrpc.AuthzDecision) {
+			mu.Lock()
+			decisions = append(decisions, d)
+			mu.Unlock()
+		},
+	}))
+
+	sess, err := pgrpc.NewSession(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	ln, err := sess.Listen("store-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serveHealth(ln).Stop()
+	raw, err := pgrpc.Listen(addr, "store-raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	go serveEcho(raw)
+	waitServer(t, c, "store-1")
+	waitServer(t, c, "store-raw")
+
+	cc, err := c.Dial("store-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.PutCC(cc, nil)
+	client := healthpb.NewHealthClient(cc)
+
+	incoming := func(caller string) context.Context {
+		return metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-caller", caller))
+	}
+	for _, tc := range []struct {
+		ctx   context.Context
+		watch bool
+		allow bool
+	}{
+		{pgrpc.ContextWithCaller(context.Background(), "ops-1"), true, true},
+		{pgrpc.ContextWithCaller(context.Background(), "web"), true, false},
+		{pgrpc.ContextWithCaller(context.Background(), "web"), false, true},
+		{pgrpc.ContextWithCaller(context.Background(), "api"), false, false},
+		{pgrpc.ContextWithCaller(incoming("api"), "web"), false, true},
+		{incoming("web"), false, true},
+		{context.Background(), false, false},
+	} {
+		ctx, cancel := context.WithTimeout(tc.ctx, 5*time.Second)
+		if tc.watch {
+			var stream healthpb.Health_WatchClient
+			if stream, err = client.Watch(ctx, &healthpb.HealthCheckRequest{}); err == nil {
+				_, err = stream.Recv()
+			}
+		} else {
+			_, err = client.Check(ctx, &healthpb.HealthCheckRequest{})
+		}
+		cancel()
+
+		if tc.allow && err != nil {
+			t.Errorf("%+v: unexpected error: %v", tc, err)
+		}
+		if !tc.allow && status.Code(err) != codes.PermissionDenied {
+			t.Errorf("%+v: not denied: %v", tc, err)
+		}
+	}
+
+	// raw conns are checked per id
+	conn, err := c.DialConn(pgrpc.ContextWithCaller(context.Background(), "web"), "store-raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	echo(t, conn, "hello from web")
+	if _, err := c.DialConn(pgrpc.ContextWithCaller(context.Background(), "api"), "store-raw"); errors.Cause(err) != pgrpc.ErrUnauthorized {
+		t.Fatalf("raw conn not denied: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(decisions) != 4 || c.Stats().Denied != 4 {
+		t.Fatalf("unexpected denied count: %d, %d", len(decisions), c.Stats().Denied)
+	}
+	if d := decisions[0]; d.Caller != "web" || d.ID != "store-1" ||
+		d.Method != "/grpc.health.v1.Health/Watch" || d.Rule != 1 || d.Allowed {
+		t.Errorf("unexpected decision: %+v", d)
+	}
+	if d := decisions[3]; d.Caller != "api" || d.ID != "store-raw" || d.Method != "" || d.Rule != -1 {
+		t.Errorf("unexpected decision: %+v", d)
+	}
+
+	if _, err := pgrpc.NewClient("127.0.0.1:0", pgrpc.WithAuthz(pgrpc.AuthzPolicy{
+		Rules: []pgrpc.AuthzRule{{IDs: []string{"["}}}})); err == nil {
+		t.Error("invalid pattern accepted")
+	}
+}
@@ -1,9 +1,8 @@
 package pgrpc
 
 import (
-	"bytes"
 	"context"
-	"io"
+	"crypto/tls"
 	"net"
 	"sync"
 	"time"
@@ -13,7 +12,18 @@ import (
 )
 
 type Client struct {
-	sync.Map
+	sync.Map // pools by id
+
+	remotesMu sync.Mutex
+	remotes   map[string]*remote // see remoteKey
+	dialed    sync.Map           // *ccOwner by the ClientConns dialed by pools
+
+	statsMu    sync.Mutex
+	rejected   map[string]uint64 // by reason
+	conns      int
+	handshakes int
+	denied     uint64             // calls denied by WithAuthz
+	buckets    map[string]*bucket // by source ip, see Limits.Rate
 
 	clientOpts
 }
@@ -33,11 +43,46 @@ func NewClient(addr string, opts ...ClientOpt) (*Client, error) {
 		return nil, err
 	}
 
-	var c = &Client{}
+	c, err := NewClientWithListener(ln, opts...)
+	if err != nil {
+		ln.Close()
+	}
+	return c, err
+}
+
+// NewClientWithListener init a new client serving the conns of ln, eg: a
+// ProxyListener
+func NewClientWithListener(ln net.Listener, opts ...ClientOpt) (*Client, error) {
+	var c = &Client{
+		remotes:  map[string]*remote{},
+		rejected: map[string]uint64{},
+		buckets:  map[string]*bucket{},
+		clientOpts: clientOpts{
+			handshakeTimeout: defaultHandshakeTimeout,
+			keepAlive:        defaultKeepAlive,
+			pingInterval:     defaultPingInterval,
+			minIdle:          MIN_IDLE,
+			maxIdle:          MAX_IDLE,
+			directTimeout:    defaultDirectTimeout,
+		},
+	}
 	for _, opt := range opts {
 		opt.applyClient(&c.clientOpts)
 	}
+	if c.err != nil {
+		return nil, c.err
+	}
+	if v := c.tokenVerifier; v != nil {
+		v.creds = c.creds
+		if len(v.keys()) == 0 {
+			return nil, errors.New("no token key")
+		}
+	}
+	if c.closeRevoked && c.creds != nil {
+		c.creds.notify(c.revalidate)
+	}
 
+	go c.pingLoop()
 	go func() {
 		for {
 			conn, err := ln.Accept()
@@ -46,45 +91,103 @@ func NewClient(addr string, opts ...ClientOpt) (*Client, error) {
 				continue
 			}
 
-			go func(conn net.Conn) {
-				for _, fn := range c.onAccept {
-					if conn, err = fn(conn); err != nil {
-						c.Log("run tcp accept hook fail: %s", err)
-						conn.Close()
-						return
-					}
-				}
-
-				// read connection id
-				var id string
-				{
-					buf := make([]byte, MAX_ID_LEN)
-					conn.SetDeadline(time.Now().Add(5 * time.Second))
-					if _, err := io.ReadFull(conn, buf); err != nil {
-						c.Log("read connection fail: %s, readed: %s", err, buf)
-						conn.Close()
-						return
-					}
-
-					conn.SetDeadline(time.Time{})
-					id = string(bytes.TrimRight(buf, string(0)))
-				}
+			tracked, ok := c.track(conn)
+			if !ok { // closed first, not to wait for a lazy PROXY header
+				conn.Close()
+				c.reject(conn.RemoteAddr(), "", RejectHandshakeLimit)
+				continue
+			}
 
-				if c, ok := conn.(*net.TCPConn); ok {
-					c.SetKeepAlive(true)
-					c.SetKeepAlivePeriod(5 * time.Second)
+			go func(conn net.Conn) {
+				conn, h, err := c.accept(conn)
+				c.handshaked()
+				if err != nil {
+					c.Log("handshake with %s fail: %s", conn.RemoteAddr(), err)
+					conn.Close()
+					return
 				}
 
-				// cache connection
-				if val, ok := c.LoadOrStore(id, &pool{id: id, conns: []net.Conn{conn}, Client: c}); ok {
-					val.(*pool).PutConn(id, conn)
+				r, a := c.attach(conn, h)
+				switch h.Kind {
+				case kindData: // cache connection
+					r.put(&idleConn{Conn: conn, admission: a})
+				case kindCtrl:
+					r.serveCtrl(conn, a)
+				case kindMux:
+					r.serveMux(conn, a)
 				}
-			}(conn)
+			}(tracked)
 		}
 	}()
 	return c, nil
 }
 
+// accept run accept hooks on an accepted conn, check its source, then
+// handshake
+func (c *Client) accept(conn net.Conn) (net.Conn, *hello, error) {
+	setKeepAlive(conn, c.keepAlive)
+
+	for _, fn := range c.onAccept {
+		hooked, err := fn(conn)
+		if err != nil {
+			return conn, nil, errors.Wrap(err, "run tcp accept hook")
+		}
+		conn = hooked
+	}
+
+	if !c.allowSource(conn.RemoteAddr()) {
+		c.reject(conn.RemoteAddr(), "", RejectSource)
+		return conn, nil, errors.New("source not allowed")
+	}
+	return c.handshake(conn, c.admit)
+}
+
+// handshake run the noise and tls handshakes, then read the hello. The hello
+// is checked by admit if any, a rejection is told to the server in the ack.
+func (c *Client) handshake(conn net.Conn, admit func(net.Conn, *hello) error) (net.Conn, *hello, error) {
+	conn.SetDeadline(time.Now().Add(c.handshakeTimeout))
+	var peer *NoisePeer
+	if c.noise != nil {
+		nc, err := noiseHandshake(conn, c.noise, false)
+		if err != nil {
+			c.reject(conn.RemoteAddr(), "", RejectNoise)
+			return conn, nil, errors.Wrap(err, "noise handshake")
+		}
+		conn, peer = nc, nc.peer
+	}
+	config := c.tlsConfig
+	if c.creds != nil {
+		config = c.creds.tlsConfig(config, true)
+	}
+	if config != nil {
+		tlsConn := tls.Server(conn, config)
+		if err := tlsConn.Handshake(); err != nil {
+			return conn, nil, errors.Wrap(err, "tls handshake")
+		}
+		conn = tlsConn
+	}
+
+	h, err := readHello(conn)
+	if err != nil {
+		return conn, nil, errors.Wrap(err, "read hello")
+	}
+	h.noisePeer = peer
+	if admit != nil {
+		if err := admit(conn, h); err != nil {
+			if e, ok := err.(*rejectError); ok {
+				writeHelloAck(conn, &helloAck{Reject: e.reason, Backoff: int64(e.backoff / time.Millisecond)})
+			}
+			return conn, nil, err
+		}
+	}
+
+	if err := writeHelloAck(conn, &helloAck{}); err != nil {
+		return conn, nil, errors.Wrap(err, "write hello ack")
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, h, nil
+}
+
 // Dial build a new connection from the global client
 func Dial(key string) (*grpc.ClientConn, error) {
 	return defaultClient.Dial(key)
@@ -101,6 +204,27 @@ func (c *Client) Dial(key string) (*grpc.ClientConn, error) {
 	return cc, errors.Wrap(err, "pgrpc dial")
 }
 
+// DialConn take a raw connection from the global client
+func DialConn(ctx context.Context, key string) (net.Conn, error) {
+	return defaultClient.DialConn(ctx, key)
+}
+
+// DialConn take a raw connection to the server with id key, it is accepted
+// from the Listener of the id on the server
+func (c *Client) DialConn(ctx context.Context, key string) (net.Conn, error) {
+	if err := c.authorize(ctx, key, ""); err != nil {
+		return nil, err
+	}
+
+	val, ok := c.Load(key)
+	if !ok {
+		return nil, errors.Errorf("connection point to %s not found", key)
+	}
+
+	conn, err := val.(*pool).GetConn(ctx)
+	return conn, errors.Wrap(err, "pgrpc dial conn")
+}
+
 func Each(fn func(id string, cc *grpc.ClientConn) error) {
 	defaultClient.Each(fn)
 }
@@ -113,6 +237,10 @@ func (c *Client) Each(fn func(id string, cc *grpc.ClientConn) error) {
 		go func(id string, pool *pool) {
 			defer wg.Done()
 
+			if pool.Draining() {
+				return
+			}
+
 			cc, err := pool.Get()
 			if err != nil {
 				c.Log("pgrpc dial %s fail: %s", key, err)
@@ -133,51 +261,64 @@ func PutCC(cc *grpc.ClientConn, err error) {
 	defaultClient.PutCC(cc, err)
 }
 func (c *Client) PutCC(cc *grpc.ClientConn, err error) {
-	val, ok := c.Load(cc.Target())
+	if cc == nil {
+		return
+	}
+	val, ok := c.dialed.Load(cc)
 	if !ok {
 		return
 	}
 
-	pool := val.(*pool)
-	pool.PutCC(cc, err)
+	val.(*ccOwner).pool.PutCC(cc, err)
 }
 
-// pool maintain idle connections
+// ccOwner is the pool and the remote a ClientConn is dialed from
+type ccOwner struct {
+	pool   *pool
+	remote *remote
+}
+
+// pool maintain the conns to an id, dialed by the Sessions registering it
 type pool struct {
-	id    string
-	conns []net.Conn
-	ccs   []*grpc.ClientConn
+	id      string
+	remotes []*remote
+	ccs     []*grpc.ClientConn
+	next    int           // round robin of remotes
+	wait    chan struct{} // closed while a conn is put
 
 	*Client
 	mu sync.Mutex
 }
 
 func (s *pool) Get() (cc *grpc.ClientConn, err error) {
-	for i := 0; i < 20; /* 6s > 5s */ i++ {
+	ctx, cancel := context.WithTimeout(context.Background(), 6*time.Second /* > 5s */)
+	defer cancel()
+
+	for {
 		s.mu.Lock()
 		if len(s.ccs) != 0 {
 			cc = s.ccs[0]
 			s.ccs = s.ccs[1:]
 			s.mu.Unlock()
 
-			cc.Close()
+			s.closeCC(cc)
 			continue
 		}
+		s.mu.Unlock()
 
 		// no avaiable ClientConn, try build from net.Conn
-		if len(s.conns) == 0 {
-			s.mu.Unlock()
-			time.Sleep(300 * time.Millisecond)
-			continue
+		conn, r, err := s.getConn(ctx)
+		if err != nil {
+			return nil, err
 		}
 
-		conn := s.conns[0]
-		s.conns = s.conns[1:]
-		s.mu.Unlock()
-
 		// dial client conn
-		opts := append(s.grpcDialOpts, grpc.WithContextDialer(
+		opts := append([]grpc.DialOption{}, s.grpcDialOpts...)
+		opts = append(opts, grpc.WithContextDialer(
 			func(context.Context, string) (net.Conn, error) { return conn, nil }))
+		if s.authz != nil {
+			opts = append(opts, s.authzInterceptors(s.id)...)
+		}
 		cc, err := grpc.DialContext(context.Background(), conn.RemoteAddr().String(), opts...)
 		if err != nil {
 			s.Log("grpc dail fail: %s", err)
@@ -193,33 +334,179 @@ func (s *pool) Get() (cc *grpc.ClientConn, err error) {
 				}
 			}
 			if err == nil {
+				s.dialed.Store(cc, &ccOwner{pool: s, remote: r})
 				return cc, nil
 			}
 		}
 	}
+}
 
-	return nil, errors.New("no connection to " + s.id)
+// GetConn dial the server directly if advertised, or take an idle net.Conn
+// and activate it, wait for the server to dial in if none
+func (s *pool) GetConn(ctx context.Context) (net.Conn, error) {
+	conn, _, err := s.getConn(ctx)
+	return conn, err
 }
 
-func (s *pool) PutCC(cc *grpc.ClientConn, err error) {
-	if err != nil {
-		if cc != nil {
-			cc.Close()
+// getConn is GetConn, and return the remote the conn is taken from as well
+func (s *pool) getConn(ctx context.Context) (net.Conn, *remote, error) {
+	for demanded := false; ; demanded = true {
+		if s.Draining() {
+			return nil, nil, errors.Errorf("all servers of %s are draining", s.id)
+		}
+
+		s.mu.Lock()
+		remotes := s.remotes
+		s.next++
+		next := s.next
+		if s.wait == nil {
+			s.wait = make(chan struct{})
+		}
+		wait := s.wait
+		s.mu.Unlock()
+
+		for i := range remotes {
+			r := remotes[(next+i)%len(remotes)]
+			if conn := r.takeDirect(ctx, s.id); conn != nil {
+				return conn, r, nil
+			}
+		}
+
+		for i := range remotes {
+			r := remotes[(next+i)%len(remotes)]
+			conn, err := r.take(s.id)
+			if err != nil {
+				s.Log("activate conn to %s fail: %s", s.id, err)
+				continue
+			}
+			if conn != nil {
+				return conn, r, nil
+			}
 		}
+
+		if !demanded {
+			s.demand(1)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, nil, errors.Wrap(ctx.Err(), "no connection to "+s.id)
+		case <-wait:
+		}
+	}
+}
+
+// PutCC cache cc for reuse, it is closed on error, or if the server it is
+// dialed from is draining the id, so the server does not wait for it
+func (s *pool) PutCC(cc *grpc.ClientConn, err error) {
+	if cc == nil {
 		return
 	}
+	val, ok := s.dialed.Load(cc)
+	if err != nil || !ok || val.(*ccOwner).remote.draining(s.id) {
+		s.closeCC(cc)
+		return
+	}
+
+	s.mu.Lock()
+	if len(s.ccs) >= s.maxIdle-s.minIdle {
+		s.mu.Unlock()
+		s.closeCC(cc)
+		return
+	}
+	s.ccs = append(s.ccs, cc)
+	s.mu.Unlock()
+}
+
+// closeCC close a ClientConn dialed by the pool
+func (s *pool) closeCC(cc *grpc.ClientConn) {
+	s.dialed.Delete(cc)
+	cc.Close()
+}
+
+// closeCCs close the cached ClientConns, in-flight streams are kept
+func (s *pool) closeCCs() {
+	s.mu.Lock()
+	ccs := s.ccs
+	s.ccs = nil
+	s.mu.Unlock()
+
+	for _, cc := range ccs {
+		s.closeCC(cc)
+	}
+}
+
+// addRemote share the conns of a server Session with the pool
+func (s *pool) addRemote(r *remote) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, rr := range s.remotes {
+		if rr == r {
+			return
+		}
+	}
+	s.remotes = append(s.remotes, r)
+	s.notify()
+}
+
+func (s *pool) removeRemote(r *remote) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	remotes := make([]*remote, 0, len(s.remotes))
+	for _, rr := range s.remotes {
+		if rr != r {
+			remotes = append(remotes, rr)
+		}
+	}
+	s.remotes = remotes
+}
 
+// Draining report whether all servers of the pool are draining
+func (s *pool) Draining() bool {
 	s.mu.Lock()
-	if len(s.ccs) == (MAX_IDLE - MIN_IDLE) {
-		cc.Close()
-	} else {
-		s.ccs = append(s.ccs, cc)
+	remotes := s.remotes
+	s.mu.Unlock()
+
+	for _, r := range remotes {
+		if !r.draining(s.id) {
+			return false
+		}
 	}
+	return len(remotes) != 0
+}
+
+// Idle return the number of idle conns cached for the pool
+func (s *pool) Idle() int {
+	s.mu.Lock()
+	remotes := s.remotes
 	s.mu.Unlock()
+
+	n := 0
+	for _, r := range remotes {
+		n += r.idle(s.id)
+	}
+	return n
 }
 
-func (s *pool) PutConn(id string, conn net.Conn) {
+// demand ask the servers to dial n more idle conns
+func (s *pool) demand(n int) {
 	s.mu.Lock()
-	s.conns = append(s.conns, conn)
+	remotes := s.remotes
 	s.mu.Unlock()
+
+	for _, r := range remotes {
+		if !r.draining(s.id) {
+			r.demand(n)
+		}
+	}
+}
+
+// notify wake up the waiters for conns, s.mu should be held
+func (s *pool) notify() {
+	if s.wait != nil {
+		close(s.wait)
+		s.wait = nil
+	}
 }
@@ -1,6 +1,7 @@
 package pgrpc
 
 import (
+	"crypto/tls"
 	"net"
 	"time"
 
@@ -11,9 +12,30 @@ type clientOpts struct {
 	logger
 	dialTimeout time.Duration
 
+	tlsConfig        *tls.Config
+	noise            *noiseConfig
+	creds            *Credentials
+	closeRevoked     bool
+	handshakeTimeout time.Duration
+	keepAlive        time.Duration
+	pingInterval     time.Duration
+	minIdle, maxIdle int
+	directTimeout    time.Duration
+	directAllow      []*net.IPNet // direct addresses allowed to dial
+
 	grpcDialOpts []grpc.DialOption
 	onAccept     []func(net.Conn) (net.Conn, error)
 	onGrpcDial   []func(*grpc.ClientConn) error
+
+	allowSources []*net.IPNet // nil allows all
+	idSources    []idSource
+	onReject     []func(*RejectEvent)
+	limits       Limits
+
+	tokenVerifier *tokenVerifier
+	authz         *AuthzPolicy
+
+	err error // invalid option, returned by NewClient
 }
 
 func (co *clientOpts) Log(format string, a ...interface{}) {
@@ -40,27 +62,31 @@ func (o *grpcDialOpt) applyClient(co *clientOpts) {
 }
 
 type proxyProtocol struct {
-	net.Conn
-	remoteAddr net.Addr
+	policy *ProxyPolicy
 }
 
-// WithProxyProtocol set proxy protocol support
+// WithProxyProtocol parse the PROXY protocol v1 or v2 header of accepted
+// conns from any peer, whose RemoteAddr and LocalAddr are the source and
+// destination of the header, see ParseProxyHeader. Use WithProxyPolicy to
+// accept headers only from trusted peers.
 func WithProxyProtocol() ClientOpt {
 	return &proxyProtocol{}
 }
+
+// WithProxyPolicy parse PROXY protocol headers like WithProxyProtocol, but
+// only trust them from the trusted peers of policy
+func WithProxyPolicy(policy ProxyPolicy) ClientOpt {
+	return &proxyProtocol{policy: &policy}
+}
 func (o *proxyProtocol) applyClient(co *clientOpts) {
+	checker, err := newProxyChecker(o.policy, co.Log)
+	if err != nil {
+		co.err = err
+		return
+	}
+
 	co.onAccept = append(co.onAccept,
 		func(conn net.Conn) (net.Conn, error) {
-			c, ip, err := ParseProxyProto(o.Conn)
-			if err != nil {
-				return c, err
-			}
-
-			addr := c.RemoteAddr().(*net.TCPAddr)
-			addr.IP = net.ParseIP(ip)
-			return &proxyProtocol{Conn: c, remoteAddr: addr}, nil
+			return checker.parse(conn, co.handshakeTimeout)
 		})
 }
-func (o *proxyProtocol) RemoteAddr() net.Addr {
-	return o.remoteAddr
-}
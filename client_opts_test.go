@@ -0,0 +1,111 @@
+package pgrpc_test
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wweir/pgrpc"
+)
+
+// helloAfter send header and a hello for id on a new conn to addr, and return
+// the ack payload, empty if the conn is closed without an ack
+func helloAfter(t *testing.T, addr, header, id string) string {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte(header)); err != nil {
+		t.Fatal(err)
+	}
+	writeHello(t, conn, map[string]interface{}{"id": id, "kind": "data", "session": "policy"})
+
+	typ, payload, err := readFrame(conn)
+	if err != nil {
+		return ""
+	}
+	if typ != 0x86 {
+		t.Fatalf("unexpected frame: %#x %s", typ, payload)
+	}
+	return string(payload)
+}
+
+func Test_WithProxyPolicy(t *testing.T) {
+	header := "PROXY TCP4 10.1.1.1 10.1.1.2 1000 2000\r\n"
+
+	t.Run("trusted", func(t *testing.T) {
+		c, addr := newClient(t, pgrpc.WithSourceAllow("10.0.0.0/8"),
+			pgrpc.WithProxyPolicy(pgrpc.ProxyPolicy{Trusted: []string{"127.0.0.1"}}))
+		defer listenFrom(t, addr, "10.1.1.1", "trusted").Close()
+		waitServer(t, c, "trusted")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		conn, err := c.DialConn(ctx, "trusted")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		echo(t, conn, "hello from 10.1.1.1")
+	})
+
+	t.Run("untrusted ignored", func(t *testing.T) {
+		mu := sync.Mutex{}
+		var sources []string
+		c, addr := newClient(t, pgrpc.WithSourceAllow("10.0.0.0/8"),
+			pgrpc.WithProxyPolicy(pgrpc.ProxyPolicy{Trusted: []string{"10.0.0.0/8"}, Untrusted: pgrpc.ProxyIgnore}),
+			pgrpc.WithRejectHook(func(e *pgrpc.RejectEvent) {
+				ip, _, _ := net.SplitHostPort(e.Addr.String())
+				mu.Lock()
+				sources = append(sources, ip)
+				mu.Unlock()
+			}))
+		defer listenFrom(t, addr, "10.1.1.1", "spoofed").Close()
+
+		// the real source is checked instead of the header
+		waitFor(t, "the rejection", func() bool { return c.Stats().Rejected[pgrpc.RejectSource] != 0 })
+		mu.Lock()
+		defer mu.Unlock()
+		if sources[0] != "127.0.0.1" {
+			t.Fatalf("unexpected rejected source: %v", sources)
+		}
+		if servers := c.Servers("spoofed"); len(servers) != 0 {
+			t.Fatalf("spoofed registered: %+v", servers)
+		}
+	})
+
+	t.Run("untrusted stripped", func(t *testing.T) {
+		c, addr := newClient(t, pgrpc.WithSourceAllow("127.0.0.1"),
+			pgrpc.WithProxyPolicy(pgrpc.ProxyPolicy{Trusted: []string{"10.0.0.0/8"}, Untrusted: pgrpc.ProxyIgnore}))
+		defer listenFrom(t, addr, "10.1.1.1", "stripped").Close()
+		waitServer(t, c, "stripped")
+	})
+
+	for _, tc := range []struct {
+		name   string
+		policy pgrpc.ProxyPolicy
+		header string
+		acked  bool
+	}{
+		{"required", pgrpc.ProxyPolicy{Trusted: []string{"127.0.0.1"}, Require: true}, header, true},
+		{"required but missing", pgrpc.ProxyPolicy{Trusted: []string{"127.0.0.1"}, Require: true}, "", false},
+		{"untrusted rejected", pgrpc.ProxyPolicy{Trusted: []string{"10.0.0.0/8"}}, header, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, addr := newClient(t, pgrpc.WithProxyPolicy(tc.policy))
+			if ack := helloAfter(t, addr, tc.header, "policy"); (ack == "{}") != tc.acked {
+				t.Fatalf("unexpected ack: %q", ack)
+			}
+		})
+	}
+
+	if _, err := pgrpc.NewClient("127.0.0.1:0",
+		pgrpc.WithProxyPolicy(pgrpc.ProxyPolicy{Trusted: []string{"invalid"}})); err == nil {
+		t.Error("invalid trusted proxy accepted")
+	}
+}
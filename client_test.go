@@ -0,0 +1,113 @@
+package pgrpc_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/wweir/pgrpc"
+)
+
+func Test_DialConn(t *testing.T) {
+	c, addr := newClient(t)
+	ln, err := pgrpc.Listen(addr, "ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// the server speaks first like ssh, so a conn is accepted only once the
+	// client takes it
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.Write([]byte("SSH-2.0\r\n"))
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	waitServer(t, c, "ssh")
+
+	// conns in use at the same time are independent
+	conns := make([]net.Conn, 5)
+	for i := range conns {
+		if conns[i], err = c.DialConn(context.Background(), "ssh"); err != nil {
+			t.Fatal(err)
+		}
+		defer conns[i].Close()
+	}
+	for i, conn := range conns {
+		banner := make([]byte, len("SSH-2.0\r\n"))
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(conn, banner); err != nil || string(banner) != "SSH-2.0\r\n" {
+			t.Fatalf("unexpected banner: %q, %v", banner, err)
+		}
+		echo(t, conn, fmt.Sprintf("hello %d", i))
+	}
+
+	if _, err := c.DialConn(context.Background(), "unknown"); err == nil {
+		t.Fatal("dial to an unknown id succeeded")
+	}
+}
+
+func Test_WithCloseRevoked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pgrpc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sources := filepath.Join(dir, "sources")
+	if err := ioutil.WriteFile(sources, []byte("127.0.0.1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	creds, err := pgrpc.NewCredentials(pgrpc.CredentialFiles{Sources: sources})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, addr := newClient(t, pgrpc.WithCredentials(creds), pgrpc.WithCloseRevoked())
+	ln, err := pgrpc.Listen(addr, "revoked")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go serveEcho(ln)
+	waitServer(t, c, "revoked")
+
+	// a conn taken by an in-flight call
+	conn, err := c.DialConn(context.Background(), "revoked")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	echo(t, conn, "before revoked")
+
+	if err := ioutil.WriteFile(sources, []byte("10.0.0.0/8\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	mod := time.Now().Add(time.Hour)
+	os.Chtimes(sources, mod, mod)
+	if err := creds.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil || os.IsTimeout(err) {
+		t.Fatalf("taken conn not closed: %v", err)
+	}
+	if n := c.Stats().Rejected[pgrpc.RejectRevoked]; n == 0 {
+		t.Fatal("no revoked conn reported")
+	}
+}
@@ -0,0 +1,75 @@
+// pgrpc-agent reverse-exposes an existing local gRPC (or any HTTP/2) server
+// through a pgrpc client, without changing the server's code.
+//
+//	pgrpc-agent -client 10.0.0.1:50052 -id edge-1 -target 127.0.0.1:50051
+//	pgrpc-agent -client 10.0.0.1:50052 -id edge-1 -target unix:///run/app.sock
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/wweir/pgrpc"
+)
+
+func init() {
+	log.SetFlags(log.Ltime | log.Lshortfile)
+}
+
+func main() {
+	client := flag.String("client", "", "pgrpc client address to dial out to")
+	id := flag.String("id", "", "id to register on the pgrpc client")
+	target := flag.String("target", "", "local server address, host:port or unix:///path")
+	flag.Parse()
+
+	if *client == "" || *id == "" || *target == "" {
+		flag.Usage()
+		log.Fatalln("client, id and target are required")
+	}
+
+	network, address := "tcp", *target
+	if strings.HasPrefix(address, "unix://") {
+		network, address = "unix", strings.TrimPrefix(address, "unix://")
+	}
+
+	ln, err := pgrpc.Listen(*client, *id, pgrpc.WithLogFunc(log.Printf))
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		go proxy(conn, network, address)
+	}
+}
+
+// proxy pipes a conn taken by the client byte-for-byte to the local server,
+// which may speak first, eg: ssh.
+func proxy(conn net.Conn, network, address string) {
+	defer conn.Close()
+
+	local, err := net.Dial(network, address)
+	if err != nil {
+		log.Printf("dial %s %s fail: %s", network, address, err)
+		return
+	}
+	defer local.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(local, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, local)
+		done <- struct{}{}
+	}()
+	<-done
+}
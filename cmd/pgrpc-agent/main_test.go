@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/wweir/pgrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// agent run the agent of id for the client c at addr, proxying to the local
+// server at address, and wait until it is registered
+func agent(t *testing.T, c *pgrpc.Client, addr, id, network, address string) net.Listener {
+	t.Helper()
+	ln, err := pgrpc.Listen(addr, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go proxy(conn, network, address)
+		}
+	}()
+
+	for deadline := time.Now().Add(5 * time.Second); len(c.Servers(id)) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s to register", id)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return ln
+}
+
+func Test_proxy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pgrpc-agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := pgrpc.NewClientWithListener(cln, pgrpc.WithGrpcDialOpt(grpc.WithInsecure()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		id, network, address string
+	}{
+		{"agent-tcp", "tcp", "127.0.0.1:0"},
+		{"agent-unix", "unix", filepath.Join(dir, "app.sock")},
+	} {
+		t.Run(tc.id, func(t *testing.T) {
+			// the existing local server, unaware of pgrpc
+			local, err := net.Listen(tc.network, tc.address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := grpc.NewServer()
+			healthpb.RegisterHealthServer(s, health.NewServer())
+			go s.Serve(local)
+			defer s.Stop()
+
+			defer agent(t, c, cln.Addr().String(), tc.id, tc.network, local.Addr().String()).Close()
+
+			cc, err := c.Dial(tc.id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.PutCC(cc, nil)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			resp, err := healthpb.NewHealthClient(cc).Check(ctx, &healthpb.HealthCheckRequest{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Status != healthpb.HealthCheckResponse_SERVING {
+				t.Fatalf("unexpected status: %s", resp.Status)
+			}
+		})
+	}
+}
+
+func Test_proxyServerFirst(t *testing.T) {
+	cln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := pgrpc.NewClientWithListener(cln)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a local server greeting first, like ssh
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	banner := "SSH-2.0-pgrpc\r\n"
+	go func() {
+		for {
+			conn, err := local.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte(banner))
+			conn.Close()
+		}
+	}()
+	defer agent(t, c, cln.Addr().String(), "agent-ssh", "tcp", local.Addr().String()).Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := c.DialConn(ctx, "agent-ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if data, err := ioutil.ReadAll(conn); err != nil || string(data) != banner {
+		t.Fatalf("unexpected banner: %q, %v", data, err)
+	}
+}
@@ -0,0 +1,334 @@
+package pgrpc
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// RejectRevoked is the reason of a RejectEvent of a conn closed since its
+// credentials are revoked, see WithCloseRevoked
+const RejectRevoked = "revoked"
+
+// credentialCheck is how often the credential files are checked for changes
+const credentialCheck = time.Second
+
+// CredentialFiles are the files of Credentials, empty ones are not used
+type CredentialFiles struct {
+	Cert, Key string // PEM tls certificate and key
+	CA        string // PEM tls CA certificates verifying the peer
+	Token     string // signed token presented by the server, see WithToken
+	TokenKeys string // PEM public keys verifying the tokens on the client, see TokenAuth
+	Sources   string // IPs or CIDRs allowed by the client, one per line, see WithSourceAllow
+}
+
+// Credentials provide the credentials of new handshakes from files, the
+// files are checked for changes at most every second, or reloaded on demand
+// by Reload. Files failing to load keep the last credentials.
+type Credentials struct {
+	files CredentialFiles
+
+	mu        sync.Mutex
+	checked   time.Time
+	modTimes  map[string]time.Time
+	cert      *tls.Certificate
+	ca        *x509.CertPool
+	token     string
+	tokenKeys []crypto.PublicKey
+	sources   []*net.IPNet
+	onReload  []func()
+}
+
+type credentials struct {
+	creds *Credentials
+}
+
+// NewCredentials load the credential files
+func NewCredentials(files CredentialFiles) (*Credentials, error) {
+	if (files.Cert == "") != (files.Key == "") {
+		return nil, errors.New("tls certificate and key should be set together")
+	}
+
+	c := &Credentials{files: files, modTimes: map[string]time.Time{}}
+	if _, err := c.reload(true); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// WithCredentials use the credentials of creds for new handshakes, the tls
+// certificate and CA are set to the tls config, eg: of WithTLSConfig. It is
+// shared by clients and servers.
+func WithCredentials(creds *Credentials) *credentials {
+	return &credentials{creds: creds}
+}
+func (o *credentials) applyClient(co *clientOpts) {
+	co.creds = o.creds
+}
+func (o *credentials) applyServer(so *serverOpts) {
+	so.creds = o.creds
+}
+
+// Reload reload the changed files now, the client closes the conns of revoked
+// credentials if WithCloseRevoked
+func (c *Credentials) Reload() error {
+	changed, err := c.reload(false)
+	if changed {
+		c.mu.Lock()
+		fns := c.onReload
+		c.mu.Unlock()
+		for _, fn := range fns {
+			fn()
+		}
+	}
+	return err
+}
+
+// check reload the changed files if not checked for a while
+func (c *Credentials) check() {
+	c.mu.Lock()
+	due := time.Since(c.checked) >= credentialCheck
+	c.mu.Unlock()
+	if due {
+		c.Reload()
+	}
+}
+
+// reload load the changed files, or all of them if force
+func (c *Credentials) reload(force bool) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checked = time.Now()
+
+	var errs []string
+	changed := false
+	load := func(files []string, fn func(data [][]byte) error) {
+		var data [][]byte
+		var modTimes []time.Time
+		modified := force
+		for _, file := range files {
+			info, err := os.Stat(file)
+			if err != nil {
+				errs = append(errs, err.Error())
+				return
+			}
+			if !info.ModTime().Equal(c.modTimes[file]) {
+				modified = true
+			}
+			modTimes = append(modTimes, info.ModTime())
+		}
+		if !modified {
+			return
+		}
+
+		for _, file := range files {
+			d, err := ioutil.ReadFile(file)
+			if err != nil {
+				errs = append(errs, err.Error())
+				return
+			}
+			data = append(data, d)
+		}
+		if err := fn(data); err != nil {
+			errs = append(errs, errors.Wrap(err, files[0]).Error())
+			return
+		}
+		for i, file := range files {
+			c.modTimes[file] = modTimes[i]
+		}
+		changed = true
+	}
+
+	if c.files.Cert != "" {
+		load([]string{c.files.Cert, c.files.Key}, func(data [][]byte) error {
+			cert, err := tls.X509KeyPair(data[0], data[1])
+			if err == nil {
+				c.cert = &cert
+			}
+			return err
+		})
+	}
+	if c.files.CA != "" {
+		load([]string{c.files.CA}, func(data [][]byte) error {
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(data[0]) {
+				return errors.New("no CA certificate found")
+			}
+			c.ca = pool
+			return nil
+		})
+	}
+	if c.files.Token != "" {
+		load([]string{c.files.Token}, func(data [][]byte) error {
+			c.token = strings.TrimSpace(string(data[0]))
+			return nil
+		})
+	}
+	if c.files.TokenKeys != "" {
+		load([]string{c.files.TokenKeys}, func(data [][]byte) error {
+			keys, err := ParsePublicKeys(data[0])
+			if err == nil {
+				c.tokenKeys = keys
+			}
+			return err
+		})
+	}
+	if c.files.Sources != "" {
+		load([]string{c.files.Sources}, func(data [][]byte) error {
+			var addrs []string
+			scanner := bufio.NewScanner(bytes.NewReader(data[0]))
+			for scanner.Scan() {
+				line := scanner.Text()
+				if i := strings.IndexByte(line, '#'); i >= 0 {
+					line = line[:i]
+				}
+				if line = strings.TrimSpace(line); line != "" {
+					addrs = append(addrs, line)
+				}
+			}
+			nets, err := parseNets(addrs)
+			if err == nil {
+				c.sources = append([]*net.IPNet{}, nets...)
+			}
+			return err
+		})
+	}
+
+	if len(errs) != 0 {
+		return changed, errors.Errorf("load credentials: %s", strings.Join(errs, "; "))
+	}
+	return changed, nil
+}
+
+// notify call fn once the credentials are reloaded
+func (c *Credentials) notify(fn func()) {
+	c.mu.Lock()
+	c.onReload = append(c.onReload, fn)
+	c.mu.Unlock()
+}
+
+// tlsConfig return the tls config of a new handshake, base with the current
+// certificate and CA. The CA verifies the client certificates if isServer,
+// nil if no tls.
+func (c *Credentials) tlsConfig(base *tls.Config, isServer bool) *tls.Config {
+	c.check()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.cert == nil && c.ca == nil {
+		return base
+	}
+	config := &tls.Config{}
+	if base != nil {
+		config = base.Clone()
+	}
+	if c.cert != nil {
+		config.Certificates = []tls.Certificate{*c.cert}
+	}
+	if c.ca != nil {
+		if isServer {
+			config.ClientCAs = c.ca
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		} else {
+			config.RootCAs = c.ca
+		}
+	}
+	return config
+}
+
+// verifyClient report whether the client certificate of a tls conn still
+// verifies with the current CA
+func (c *Credentials) verifyClient(conn *tls.Conn) bool {
+	c.mu.Lock()
+	ca := c.ca
+	c.mu.Unlock()
+
+	certs := conn.ConnectionState().PeerCertificates
+	if ca == nil || len(certs) == 0 {
+		return ca == nil
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         ca,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(opts)
+	return err == nil
+}
+
+// currentToken return the token presented by the server
+func (c *Credentials) currentToken() string {
+	c.check()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.token
+}
+
+// currentTokenKeys return the public keys verifying tokens
+func (c *Credentials) currentTokenKeys() []crypto.PublicKey {
+	c.check()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.tokenKeys
+}
+
+// allowSource report whether the source ip is allowed, true if no Sources
+func (c *Credentials) allowSource(ip net.IP) bool {
+	c.check()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.files.Sources == "" || netsContain(c.sources, ip)
+}
+
+type closeRevoked struct{}
+
+// WithCloseRevoked close the conns of servers whose credentials are revoked,
+// eg: the source is no longer allowed, the tls certificate no longer verifies
+// or the token is no longer valid. They are checked on Credentials.Reload and
+// every ping interval, the conns taken by in-flight calls are closed as well.
+func WithCloseRevoked() ClientOpt {
+	return &closeRevoked{}
+}
+func (o *closeRevoked) applyClient(co *clientOpts) {
+	co.closeRevoked = true
+}
+
+// revalidate close the conns of revoked credentials
+func (c *Client) revalidate() {
+	c.remotesMu.Lock()
+	remotes := make([]*remote, 0, len(c.remotes))
+	for _, r := range c.remotes {
+		remotes = append(remotes, r)
+	}
+	c.remotesMu.Unlock()
+
+	for _, r := range remotes {
+		r.revalidate()
+	}
+}
+
+// validConn report whether the source and tls certificate of conn are still
+// allowed
+func (c *Client) validConn(conn net.Conn) bool {
+	if !c.allowSource(conn.RemoteAddr()) {
+		return false
+	}
+	if tlsConn, ok := conn.(*tls.Conn); ok && c.creds != nil {
+		return c.creds.verifyClient(tlsConn)
+	}
+	return true
+}
@@ -0,0 +1,113 @@
+package pgrpc
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert write a self-signed certificate and its key as PEM files
+func writeCert(t *testing.T, dir, name string) (certFile, keyFile string) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IsCA:         true,
+		KeyUsage:     x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+
+	certFile, keyFile = filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return certFile, keyFile
+}
+
+// touch write a file with a new modification time
+func touch(t *testing.T, file, data string, age time.Duration) {
+	if err := ioutil.WriteFile(file, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	mod := time.Now().Add(age)
+	os.Chtimes(file, mod, mod)
+}
+
+func Test_Credentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pgrpc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeCert(t, dir, "pgrpc")
+	sources, token := filepath.Join(dir, "sources"), filepath.Join(dir, "token")
+	touch(t, sources, "# lan\n10.0.0.0/8\n", -time.Hour)
+	touch(t, token, "token-1\n", -time.Hour)
+
+	creds, err := NewCredentials(CredentialFiles{
+		Cert: certFile, Key: keyFile, CA: certFile, Token: token, Sources: sources})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded := 0
+	creds.notify(func() { reloaded++ })
+
+	if config := creds.tlsConfig(nil, true); len(config.Certificates) != 1 || config.ClientCAs == nil {
+		t.Errorf("unexpected tls server config: %+v", config)
+	}
+	if config := creds.tlsConfig(nil, false); len(config.Certificates) != 1 || config.RootCAs == nil {
+		t.Errorf("unexpected tls client config: %+v", config)
+	}
+	if !creds.allowSource(net.ParseIP("10.1.1.1")) || creds.allowSource(net.ParseIP("192.168.1.1")) {
+		t.Error("unexpected sources")
+	}
+
+	// unchanged files are not reloaded
+	if err := creds.Reload(); err != nil || reloaded != 0 {
+		t.Fatalf("unexpected reload: %v, %d", err, reloaded)
+	}
+
+	touch(t, sources, "192.168.1.0/24\n", 0)
+	touch(t, token, "token-2\n", 0)
+	if err := creds.Reload(); err != nil || reloaded != 1 {
+		t.Fatalf("unexpected reload: %v, %d", err, reloaded)
+	}
+	if creds.allowSource(net.ParseIP("10.1.1.1")) || !creds.allowSource(net.ParseIP("192.168.1.1")) {
+		t.Error("sources not reloaded")
+	}
+	if tok := creds.currentToken(); tok != "token-2" {
+		t.Errorf("token not reloaded: %q", tok)
+	}
+
+	// invalid files keep the last credentials
+	touch(t, sources, "192.168.1.0/33\n", time.Hour)
+	if err := creds.Reload(); err == nil {
+		t.Error("invalid sources accepted")
+	}
+	if !creds.allowSource(net.ParseIP("192.168.1.1")) {
+		t.Error("last sources not kept")
+	}
+
+	if _, err := NewCredentials(CredentialFiles{Cert: certFile}); err == nil {
+		t.Error("certificate without key accepted")
+	}
+}
@@ -0,0 +1,223 @@
+package pgrpc
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultDirectTimeout = 500 * time.Millisecond
+	// directBackoff is how long the client stops trying a direct address
+	// after a failure
+	directBackoff = 30 * time.Second
+)
+
+// path of a conn taken by the client
+const (
+	PathReverse = "reverse" // dialed by the server
+	PathDirect  = "direct"  // dialed by the client
+)
+
+type direct struct {
+	addr, advertise string
+}
+
+// WithDirect listen on addr for the clients able to dial the server directly,
+// the advertise address is sent to the client on registration. An empty
+// advertise is the local ip of the reverse conn with the port of addr.
+// Direct conns run the same accept hooks, tls and handshake as reverse ones,
+// the server is still the tls client.
+func WithDirect(addr, advertise string) ServerOpt {
+	return &direct{addr: addr, advertise: advertise}
+}
+func (o *direct) applyServer(so *serverOpts) {
+	so.directAddr = o.addr
+	so.directAdvertise = o.advertise
+}
+
+type directTimeout struct {
+	timeout time.Duration
+}
+
+// WithDirectTimeout set the dial timeout to the direct address advertised by
+// a server, default 500ms, 0 disables direct dial. The reverse pool is used
+// while direct dial fails, and the address is not tried again for 30s.
+// Only the addresses allowed by WithDirectAllow are dialed.
+func WithDirectTimeout(timeout time.Duration) ClientOpt {
+	return &directTimeout{timeout: timeout}
+}
+func (o *directTimeout) applyClient(co *clientOpts) {
+	co.directTimeout = o.timeout
+}
+
+type directAllow struct {
+	addrs []string
+}
+
+// WithDirectAllow dial the direct address advertised by a server only if it
+// is an ip in the IPs or CIDRs, eg: "10.0.0.0/8", and is allowed by
+// WithSourceAllow as well. It may be set multiple times, no address is
+// dialed by default.
+func WithDirectAllow(addrs ...string) ClientOpt {
+	return &directAllow{addrs: addrs}
+}
+func (o *directAllow) applyClient(co *clientOpts) {
+	nets, err := parseNets(o.addrs)
+	if err != nil {
+		co.err = err
+		return
+	}
+	co.directAllow = append(co.directAllow, nets...)
+}
+
+// allowDirect report whether the direct address is allowed to dial, a host
+// name is never allowed, the server advertises it unauthenticated
+func (co *clientOpts) allowDirect(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !netsContain(co.directAllow, ip) {
+		return false
+	}
+	return co.allowSource(&net.TCPAddr{IP: ip})
+}
+
+// PathOf report whether a conn is dialed directly or reversely by its remote
+// addr, eg: net.Conn.RemoteAddr() or the grpc peer addr, on both sides
+func PathOf(addr net.Addr) string {
+	switch addr := addr.(type) {
+	case *directAddr:
+		return PathDirect
+	case *sessionAddr:
+		return addr.info.Path
+	}
+	return PathReverse
+}
+
+// directAddr mark the remote addr of a direct conn
+type directAddr struct {
+	net.Addr
+}
+
+// directConn is a conn dialed by the client to the direct address
+type directConn struct {
+	net.Conn
+}
+
+func (c *directConn) RemoteAddr() net.Addr {
+	return &directAddr{Addr: c.Conn.RemoteAddr()}
+}
+
+// serveDirect accept direct conns from the client until the Session stops
+func (s *Session) serveDirect(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if s.stopped() {
+				return
+			}
+			s.Log("direct listen fail: %s", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		go func(conn net.Conn) {
+			addr := conn.RemoteAddr()
+			setKeepAlive(conn, s.keepAlive)
+			conn, err := s.upgrade(conn)
+			if err != nil {
+				s.Log("direct conn from %s fail: %s", addr, err)
+				return
+			}
+
+			if err := s.handshake(conn, kindData, s.IDs()); err != nil {
+				s.Log("direct conn from %s fail: %s", addr, err)
+				conn.Close()
+				return
+			}
+
+			aConn := newActiveConn(s, conn)
+			aConn.direct = true
+			aConn.identity = peerIdentity(conn)
+			s.serveActiveConn(aConn)
+		}(conn)
+	}
+}
+
+// advertise return the direct address sent to the client on conn
+func (s *Session) advertise(conn net.Conn) string {
+	if s.direct == nil || s.directAdvertise != "" {
+		return s.directAdvertise
+	}
+
+	host, _, _ := net.SplitHostPort(conn.LocalAddr().String())
+	_, port, _ := net.SplitHostPort(s.direct.Addr().String())
+	return net.JoinHostPort(host, port)
+}
+
+// dialDirect dial the direct address of the server and take the conn for id
+func (r *remote) dialDirect(ctx context.Context, addr, id string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.directTimeout)
+	defer cancel()
+
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	setKeepAlive(conn, r.keepAlive)
+
+	// the server should be the one of the remote, and be allowed to serve id
+	// from the direct address
+	conn, h, err := r.handshake(conn, func(conn net.Conn, h *hello) error {
+		return r.admitIDs(conn.RemoteAddr(), h)
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if key := remoteKey(conn, h); key != r.key {
+		conn.Close()
+		return nil, errors.Errorf("unexpected server: %s", key)
+	}
+	if !contains(h.IDs, id) {
+		conn.Close()
+		return nil, errors.Errorf("%s is not allowed from %s", id, addr)
+	}
+
+	if err := r.activate(conn, id); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	a := &admission{addr: conn.RemoteAddr(), hello: h}
+	return &directConn{Conn: r.track(conn, a)}, nil
+}
+
+// takeDirect take a direct conn for id if the server advertises an allowed
+// direct address which is not failing
+func (r *remote) takeDirect(ctx context.Context, id string) net.Conn {
+	r.mu.Lock()
+	addr := r.direct
+	skip := r.directTimeout <= 0 || addr == "" || r.ids[id] ||
+		time.Since(r.directFail) < directBackoff || !r.allowDirect(addr)
+	r.mu.Unlock()
+	if skip {
+		return nil
+	}
+
+	conn, err := r.dialDirect(ctx, addr, id)
+	if err != nil {
+		r.Log("direct dial %s fail, fall back to reverse conns: %s", addr, err)
+		r.mu.Lock()
+		if r.direct == addr {
+			r.directFail = time.Now()
+		}
+		r.mu.Unlock()
+		return nil
+	}
+	return conn
+}
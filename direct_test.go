@@ -0,0 +1,75 @@
+package pgrpc_test
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/wweir/pgrpc"
+)
+
+func Test_WithDirect(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		host string // advertised host
+		opts []pgrpc.ClientOpt
+		path string
+	}{
+		{"not allowed by default", "127.0.0.1:", nil, pgrpc.PathReverse},
+		{"allowed", "127.0.0.1:",
+			[]pgrpc.ClientOpt{pgrpc.WithDirectAllow("127.0.0.1")}, pgrpc.PathDirect},
+		{"out of direct allow", "127.0.0.2:",
+			[]pgrpc.ClientOpt{pgrpc.WithDirectAllow("127.0.0.1")}, pgrpc.PathReverse},
+		{"out of source allow", "127.0.0.2:",
+			[]pgrpc.ClientOpt{pgrpc.WithDirectAllow("127.0.0.0/8"), pgrpc.WithSourceAllow("127.0.0.1")}, pgrpc.PathReverse},
+		{"host name", "localhost:",
+			[]pgrpc.ClientOpt{pgrpc.WithDirectAllow("0.0.0.0/0", "::/0")}, pgrpc.PathReverse},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			port := freePort(t)
+			c, addr := newClient(t, tc.opts...)
+			ln, err := pgrpc.Listen(addr, "direct", pgrpc.WithDirect("0.0.0.0:"+port, tc.host+port))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			go serveEcho(ln)
+			waitServer(t, c, "direct")
+
+			conn, err := c.DialConn(context.Background(), "direct")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			echo(t, conn, "hello "+tc.name)
+			if path := pgrpc.PathOf(conn.RemoteAddr()); path != tc.path {
+				t.Fatalf("unexpected path: %s, want %s", path, tc.path)
+			}
+		})
+	}
+}
+
+func Test_ListenInvalidID(t *testing.T) {
+	port := freePort(t)
+	if _, err := pgrpc.Listen("127.0.0.1:1", "", pgrpc.WithDirect("0.0.0.0:"+port, "127.0.0.1:"+port)); err == nil {
+		t.Fatal("empty id accepted")
+	}
+
+	// the Session is closed with its direct listener
+	ln, err := net.Listen("tcp", "0.0.0.0:"+port)
+	if err != nil {
+		t.Fatalf("direct listener leaked: %v", err)
+	}
+	ln.Close()
+}
+
+// freePort return a free tcp port on all addresses
+func freePort(t *testing.T) string {
+	ln, err := net.Listen("tcp", "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	return port
+}
@@ -0,0 +1,181 @@
+package pgrpc
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// forward reply status, the first byte of the frameForward reply payload
+const (
+	forwardOK byte = iota
+	forwardDenied
+	forwardUnreachable
+)
+
+// DialForward connect to target through the server with the global client
+func DialForward(ctx context.Context, id, target string) (net.Conn, error) {
+	return defaultClient.DialForward(ctx, id, target)
+}
+
+// DialForward connect to target (host:port) on the network of the server id,
+// the server should serve the conns by ServeForward
+func (c *Client) DialForward(ctx context.Context, id, target string) (net.Conn, error) {
+	conn, err := c.DialConn(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if err := writeFrame(conn, frameForward, []byte(target)); err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "pgrpc write forward frame")
+	}
+
+	typ, payload, err := readFrame(conn)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "pgrpc read forward frame")
+	}
+	conn.SetDeadline(time.Time{})
+
+	if typ != frameForward || len(payload) == 0 {
+		conn.Close()
+		return nil, errors.Errorf("invalid forward reply: %#x", typ)
+	}
+	if payload[0] != forwardOK {
+		conn.Close()
+		return nil, &ForwardError{Status: payload[0], Msg: string(payload[1:])}
+	}
+	return conn, nil
+}
+
+// Forward serve ln, every accepted conn is forwarded through the server id to
+// target, like ssh -L. It returns when ln is closed.
+func Forward(ln net.Listener, id, target string) error {
+	return defaultClient.Forward(ln, id, target)
+}
+
+// Forward serve ln, every accepted conn is forwarded through the server id to
+// target, like ssh -L. It returns when ln is closed.
+func (c *Client) Forward(ln net.Listener, id, target string) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+
+		go func(conn net.Conn) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			ctx = ContextWithCaller(ctx, callerOfConn(conn))
+			remote, err := c.DialForward(ctx, id, target)
+			if err != nil {
+				c.Log("forward %s to %s via %s fail: %s", conn.RemoteAddr(), target, id, err)
+				conn.Close()
+				return
+			}
+			pipe(conn, remote)
+		}(conn)
+	}
+}
+
+// ForwardError is returned by DialForward while the server refuse to forward
+type ForwardError struct {
+	Status byte
+	Msg    string
+}
+
+func (e *ForwardError) Error() string {
+	return "pgrpc forward fail: " + e.Msg
+}
+
+// Denied report whether the target is not in the allowlist of the server
+func (e *ForwardError) Denied() bool {
+	return e.Status == forwardDenied
+}
+
+// ServeForward serve forward requests from the client on a Listener returned
+// by Listen, whose conns are taken by Client.Forward. Only targets matching the allowlist
+// are dialed, an entry is host:port, host may be an IP, a CIDR or *, port may
+// be *, eg: 192.168.1.0/24:22, *:443, printer.lan:9100.
+func ServeForward(ln net.Listener, allow ...string) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+
+		go serveForward(conn, allow)
+	}
+}
+
+func serveForward(conn net.Conn, allow []string) {
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	typ, payload, err := readFrame(conn)
+	if err != nil || typ != frameForward {
+		conn.Close()
+		return
+	}
+	target := string(payload)
+
+	reply := func(status byte, msg string) error {
+		return writeFrame(conn, frameForward, append([]byte{status}, msg...))
+	}
+
+	if !forwardAllowed(allow, target) {
+		reply(forwardDenied, "target "+target+" is not allowed")
+		conn.Close()
+		return
+	}
+
+	remote, err := net.DialTimeout("tcp", target, 5*time.Second)
+	if err != nil {
+		reply(forwardUnreachable, err.Error())
+		conn.Close()
+		return
+	}
+
+	if err := reply(forwardOK, ""); err != nil {
+		conn.Close()
+		remote.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	pipe(conn, remote)
+}
+
+func forwardAllowed(allow []string, target string) bool {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+
+	for _, rule := range allow {
+		rHost, rPort, err := net.SplitHostPort(rule)
+		if err != nil {
+			continue
+		}
+		if rPort != "*" && rPort != port {
+			continue
+		}
+
+		switch {
+		case rHost == "*", strings.EqualFold(rHost, host):
+			return true
+		case ip != nil && strings.Contains(rHost, "/"):
+			if _, ipNet, err := net.ParseCIDR(rHost); err == nil && ipNet.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,21 @@
+package pgrpc
+
+import "testing"
+
+func Test_forwardAllowed(t *testing.T) {
+	allow := []string{"192.168.1.0/24:22", "*:443", "printer.lan:9100"}
+
+	for target, want := range map[string]bool{
+		"192.168.1.20:22":  true,
+		"192.168.2.20:22":  false,
+		"192.168.1.20:23":  false,
+		"example.com:443":  true,
+		"PRINTER.lan:9100": true,
+		"printer.lan:80":   false,
+		"invalid":          false,
+	} {
+		if got := forwardAllowed(allow, target); got != want {
+			t.Errorf("forwardAllowed(%s) = %v, want %v", target, got, want)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package pgrpc
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// frame is the pgrpc control message sent on a reverse connection before it is
+// handed to the application: type(1) | length(2) | payload.
+// Frame types start at 0x80, so they never collide with a TLS record or the
+// h2c preface.
+const (
+	frameOpen     byte = 0x80 + iota // client takes the conn, payload is the id taken for
+	frameForward                     // forward request target, or reply status
+	frameHello                       // handshake from the server, json payload
+	frameDemand                      // ask the server to dial more idle conns
+	framePing                        // keepalive from the client
+	framePong                        // keepalive reply, echo the ping payload
+	frameHelloAck                    // handshake reply from the client, json payload
+	frameDrain                       // the id in payload is draining, avoid it for new calls
+	frameRegister                    // the server registers an id, payload is the id
+)
+
+const maxFrameLen = 1<<16 - 1
+
+func writeFrame(w io.Writer, typ byte, payload []byte) error {
+	if len(payload) > maxFrameLen {
+		return errors.Errorf("frame payload too long: %d", len(payload))
+	}
+
+	buf := make([]byte, 3+len(payload))
+	buf[0] = typ
+	binary.BigEndian.PutUint16(buf[1:3], uint16(len(payload)))
+	copy(buf[3:], payload)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+func readFrame(r io.Reader) (typ byte, payload []byte, err error) {
+	var hdr [3]byte
+	if _, err = io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+
+	payload = make([]byte, binary.BigEndian.Uint16(hdr[1:3]))
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return hdr[0], payload, nil
+}
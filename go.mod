@@ -3,6 +3,8 @@ module github.com/wweir/pgrpc
 go 1.13
 
 require (
+	github.com/flynn/noise v1.1.0
+	github.com/hashicorp/yamux v0.1.1
 	github.com/pkg/errors v0.8.1
 	google.golang.org/grpc v1.25.1
 )
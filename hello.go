@@ -0,0 +1,120 @@
+package pgrpc
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// kind of a reverse conn, sent in the hello frame
+const (
+	kindData = "data" // idle conn waiting for the client to take
+	kindCtrl = "ctrl" // persistent conn carrying control frames
+	kindMux  = "mux"  // persistent conn multiplexing logical streams
+)
+
+// hello is the first frame sent by the server on every reverse conn. Peers
+// before the hello frame, which sniff the first data of a conn instead of
+// reading an open frame, are not compatible.
+type hello struct {
+	ID      string            `json:"id"`
+	IDs     []string          `json:"ids,omitempty"` // all the ids of the Session
+	Kind    string            `json:"kind"`
+	Session string            `json:"session"`          // identify conns from the same Session
+	Direct  string            `json:"direct,omitempty"` // address the client may dial directly
+	Labels  map[string]string `json:"labels,omitempty"`
+	Token   string            `json:"token,omitempty"` // signed token, see WithToken
+
+	claims    *tokenClaims // verified token
+	noisePeer *NoisePeer   // noise key of the server
+}
+
+// helloAck is the client reply of hello
+type helloAck struct {
+	Reject  string `json:"reject,omitempty"`  // reason the registration is rejected
+	Backoff int64  `json:"backoff,omitempty"` // milliseconds to wait before redialing once rejected
+}
+
+// rejectError is a registration rejected by the client
+type rejectError struct {
+	reason  string
+	backoff time.Duration
+}
+
+func (e *rejectError) Error() string {
+	return "rejected by client: " + e.reason
+}
+
+// retryDelay return how long to wait before redialing after err
+func retryDelay(err error) time.Duration {
+	if e, ok := errors.Cause(err).(*rejectError); ok && e.backoff > time.Second {
+		return e.backoff
+	}
+	return time.Second
+}
+
+func writeHello(w io.Writer, h *hello) error {
+	payload, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	return writeFrame(w, frameHello, payload)
+}
+
+func readHello(r io.Reader) (*hello, error) {
+	typ, payload, err := readFrame(r)
+	if err != nil {
+		return nil, err
+	}
+	if typ != frameHello {
+		return nil, errors.Errorf("unexpected frame type: %#x", typ)
+	}
+
+	h := &hello{}
+	if err := json.Unmarshal(payload, h); err != nil {
+		return nil, errors.Wrap(err, "invalid hello")
+	}
+
+	if len(h.IDs) == 0 {
+		h.IDs = []string{h.ID}
+	}
+	for _, id := range h.IDs {
+		if idLen := len(id); idLen > MAX_ID_LEN {
+			return nil, errors.Errorf("id(%s) is too long", id)
+		} else if idLen == 0 {
+			return nil, errors.New("id is empty")
+		}
+	}
+	switch h.Kind {
+	case kindData, kindCtrl, kindMux:
+	default:
+		return nil, errors.Errorf("unknown conn kind: %s", h.Kind)
+	}
+	return h, nil
+}
+
+func writeHelloAck(w io.Writer, ack *helloAck) error {
+	payload, err := json.Marshal(ack)
+	if err != nil {
+		return err
+	}
+	return writeFrame(w, frameHelloAck, payload)
+}
+
+func readHelloAck(r io.Reader) (*helloAck, error) {
+	typ, payload, err := readFrame(r)
+	if err != nil {
+		return nil, err
+	}
+	if typ != frameHelloAck {
+		return nil, errors.Errorf("unexpected frame type: %#x", typ)
+	}
+
+	ack := &helloAck{}
+	if err := json.Unmarshal(payload, ack); err != nil {
+		return nil, errors.Wrap(err, "invalid hello ack")
+	}
+	return ack, nil
+}
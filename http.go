@@ -0,0 +1,84 @@
+package pgrpc
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// HTTPHostSuffix route http requests for host id.pgrpc.local to server id
+const HTTPHostSuffix = ".pgrpc.local"
+
+// HTTPTransport return a http transport routing requests by the global client
+func HTTPTransport() http.RoundTripper {
+	return defaultClient.HTTPTransport()
+}
+
+// HTTPTransport return a http transport routing requests to servers by
+// HTTPHostSuffix, eg: http://example_server.pgrpc.local/ is sent to the
+// http.Server serving the listener of Listen(addr, "example_server").
+// With WithAuthz, every request is authorized, as conns are reused by
+// requests of different callers.
+func (c *Client) HTTPTransport() http.RoundTripper {
+	transport := &http.Transport{
+		DialContext:           c.dialHTTP,
+		MaxIdleConnsPerHost:   c.maxIdle,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+	if c.authz == nil {
+		return transport
+	}
+	return &authzTransport{Transport: transport, c: c}
+}
+
+// authzTransport authorize every request before sending it
+type authzTransport struct {
+	*http.Transport
+	c *Client
+}
+
+func (t *authzTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if id, err := httpID(req.URL.Host); err == nil {
+		if err := t.c.authorize(req.Context(), id, ""); err != nil {
+			if req.Body != nil {
+				req.Body.Close()
+			}
+			return nil, err
+		}
+	}
+	return t.Transport.RoundTrip(req)
+}
+
+// httpID return the server id of a pgrpc host, the port is optional
+func httpID(addr string) (string, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+
+	if !strings.HasSuffix(host, HTTPHostSuffix) {
+		return "", errors.Errorf("host %s is not a pgrpc host *%s", host, HTTPHostSuffix)
+	}
+	return strings.TrimSuffix(host, HTTPHostSuffix), nil
+}
+
+func (c *Client) dialHTTP(ctx context.Context, network, addr string) (net.Conn, error) {
+	id, err := httpID(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	val, ok := c.Load(id)
+	if !ok {
+		return nil, errors.Errorf("connection point to %s not found", id)
+	}
+
+	conn, err := val.(*pool).GetConn(ctx)
+	return conn, errors.Wrap(err, "pgrpc dial http")
+}
@@ -0,0 +1,107 @@
+package pgrpc_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/wweir/pgrpc"
+)
+
+// get request target with ctx, and return the body
+func get(ctx context.Context, cli *http.Client, target string) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := cli.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	return string(body), err
+}
+
+func Test_HTTPTransport(t *testing.T) {
+	c, addr := newClient(t)
+	for _, id := range []string{"web-a", "web-b"} {
+		id := id
+		ln, err := pgrpc.Listen(addr, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			w.Write([]byte(id + " " + r.Method + " " + string(body)))
+		}))
+		waitServer(t, c, id)
+	}
+
+	cli := &http.Client{Transport: c.HTTPTransport()}
+	for i := 0; i < 3; i++ {
+		for _, id := range []string{"web-a", "web-b"} {
+			body, err := get(context.Background(), cli, "http://"+id+".pgrpc.local/")
+			if err != nil || body != id+" GET " {
+				t.Fatalf("unexpected response: %q, %v", body, err)
+			}
+		}
+	}
+
+	resp, err := cli.Post("http://web-b.pgrpc.local:8080/", "text/plain", strings.NewReader("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "web-b POST ping" {
+		t.Fatalf("unexpected response: %q", body)
+	}
+
+	if _, err := get(context.Background(), cli, "http://example.com/"); err == nil {
+		t.Fatal("request to a non pgrpc host succeeded")
+	}
+	if _, err := get(context.Background(), cli, "http://unknown.pgrpc.local/"); err == nil {
+		t.Fatal("request to an unknown id succeeded")
+	}
+}
+
+func Test_HTTPTransportAuthz(t *testing.T) {
+	c, addr := newClient(t, pgrpc.WithAuthz(pgrpc.AuthzPolicy{
+		Rules: []pgrpc.AuthzRule{{Callers: []string{"web"}, IDs: []string{"web"}}},
+	}))
+	ln, err := pgrpc.Listen(addr, "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello " + r.Host))
+	}))
+	waitServer(t, c, "web")
+
+	// requests of both callers share the keep-alive conn of the transport
+	cli := &http.Client{Transport: c.HTTPTransport()}
+	for i := 0; i < 2; i++ {
+		body, err := get(pgrpc.ContextWithCaller(context.Background(), "web"), cli, "http://web.pgrpc.local/")
+		if err != nil || body != "hello web.pgrpc.local" {
+			t.Fatalf("unexpected response: %q, %v", body, err)
+		}
+
+		_, err = get(pgrpc.ContextWithCaller(context.Background(), "api"), cli, "http://web.pgrpc.local/")
+		if err == nil {
+			t.Fatal("request of api is not denied")
+		}
+		if uerr, ok := err.(*url.Error); !ok || errors.Cause(uerr.Err) != pgrpc.ErrUnauthorized {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if denied := c.Stats().Denied; denied != 2 {
+		t.Fatalf("unexpected denied count: %d", denied)
+	}
+}
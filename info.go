@@ -0,0 +1,110 @@
+package pgrpc
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sort"
+
+	"google.golang.org/grpc/peer"
+)
+
+// SessionInfo describe the registration a conn taken by the client is served
+// for
+type SessionInfo struct {
+	ID         string            // id the conn is taken for
+	Session    string            // token of the server Session
+	ClientAddr net.Addr          // address of the client
+	Path       string            // PathReverse or PathDirect
+	Labels     map[string]string // labels of the Session, see WithLabels
+	Identity   string            // authenticated client identity, eg: the tls certificate CommonName
+}
+
+// SessionConn is a conn accepted from a Listener
+type SessionConn interface {
+	net.Conn
+	SessionInfo() *SessionInfo
+}
+
+// SessionFromContext return the SessionInfo of the conn serving a grpc call
+func SessionFromContext(ctx context.Context) (*SessionInfo, bool) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil, false
+	}
+	addr, ok := p.Addr.(*sessionAddr)
+	if !ok {
+		return nil, false
+	}
+	return addr.info, true
+}
+
+// sessionAddr is the remote addr of an activeConn, carrying the SessionInfo
+// to the grpc peer
+type sessionAddr struct {
+	net.Addr
+	info *SessionInfo
+}
+
+type labels struct {
+	labels map[string]string
+}
+
+// WithLabels set the labels of the Session, they are sent to the client on
+// registration and available to handlers by SessionInfo
+func WithLabels(kv map[string]string) ServerOpt {
+	return &labels{labels: kv}
+}
+func (o *labels) applyServer(so *serverOpts) {
+	so.labels = o.labels
+}
+
+// peerIdentity return the CommonName of the verified tls certificate of the
+// client, or its noise public key, empty if none
+func peerIdentity(conn net.Conn) string {
+	if nc, ok := conn.(*noiseConn); ok {
+		return nc.identity()
+	}
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	return state.PeerCertificates[0].Subject.CommonName
+}
+
+// ServerInfo describe a server Session registered on the client
+type ServerInfo struct {
+	Session string
+	IDs     []string          // registered ids, including draining ones
+	Labels  map[string]string // labels of the Session, with the claims of its token
+	Subject string            // subject of the verified token, see WithTokenAuth
+}
+
+// Servers return the servers registering id, all of them if id is empty
+func (c *Client) Servers(id string) []ServerInfo {
+	c.remotesMu.Lock()
+	defer c.remotesMu.Unlock()
+
+	var infos []ServerInfo
+	for _, r := range c.remotes {
+		r.mu.Lock()
+		if _, ok := r.ids[id]; ok || id == "" {
+			info := ServerInfo{Session: r.token, Labels: r.labels}
+			for rid := range r.ids {
+				info.IDs = append(info.IDs, rid)
+			}
+			sort.Strings(info.IDs)
+			if r.claims != nil {
+				info.Subject = r.claims.subject
+			}
+			infos = append(infos, info)
+		}
+		r.mu.Unlock()
+	}
+	return infos
+}
@@ -0,0 +1,87 @@
+package pgrpc_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/wweir/pgrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func Test_SessionInfo(t *testing.T) {
+	c, addr := newClient(t, pgrpc.WithGrpcDialOpt(grpc.WithInsecure()))
+	labels := map[string]string{"zone": "edge-1"}
+	sess, err := pgrpc.NewSession(addr, pgrpc.WithLabels(labels))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+
+	verify := func(what string, info *pgrpc.SessionInfo, id string) {
+		t.Helper()
+		servers := c.Servers(id)
+		if len(servers) != 1 || servers[0].Labels["zone"] != "edge-1" {
+			t.Fatalf("unexpected servers: %+v", servers)
+		}
+		if info.ID != id || info.Session != servers[0].Session || info.Path != pgrpc.PathReverse ||
+			info.Labels["zone"] != "edge-1" || info.ClientAddr.String() != addr {
+			t.Fatalf("unexpected %s info: %+v", what, info)
+		}
+	}
+
+	// raw conns expose the info by SessionConn
+	raw, err := sess.Listen("raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitServer(t, c, "raw")
+	conn, err := c.DialConn(context.Background(), "raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	accepted, err := raw.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer accepted.Close()
+	verify("raw conn", accepted.(pgrpc.SessionConn).SessionInfo(), "raw")
+
+	// grpc handlers by SessionFromContext
+	ln, err := sess.Listen("grpc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	infos := make(chan *pgrpc.SessionInfo, 1)
+	s := grpc.NewServer(grpc.UnaryInterceptor(func(ctx context.Context, req interface{},
+		info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if info, ok := pgrpc.SessionFromContext(ctx); ok {
+			infos <- info
+		}
+		return handler(ctx, req)
+	}))
+	healthpb.RegisterHealthServer(s, health.NewServer())
+	go s.Serve(ln)
+	defer s.Stop()
+	waitServer(t, c, "grpc")
+
+	cc, err := c.Dial("grpc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.PutCC(cc, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := healthpb.NewHealthClient(cc).Check(ctx, &healthpb.HealthCheckRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case info := <-infos:
+		verify("grpc call", info, "grpc")
+	default:
+		t.Fatal("no session info in the grpc context")
+	}
+}
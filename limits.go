@@ -0,0 +1,182 @@
+package pgrpc
+
+import (
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+const defaultRejectBackoff = 5 * time.Second
+
+// reason of a RejectEvent by Limits
+const (
+	RejectConnLimit      = "conn_limit"
+	RejectIdleLimit      = "idle_limit"
+	RejectRateLimit      = "rate_limit"
+	RejectHandshakeLimit = "handshake_limit"
+)
+
+// Limits bound the resources servers may take on a Client, zero is unlimited.
+// A registration over a limit is rejected in the hello ack, the server waits
+// for Backoff before redialing. Conns over MaxHandshakes are closed at once.
+type Limits struct {
+	MaxConns      int           // conns from servers, including in-handshake ones
+	MaxIdlePerID  int           // idle conns cached for an id
+	Rate          float64       // registrations per second from a source ip
+	Burst         int           // registrations at once from a source ip, default Rate rounded up
+	MaxHandshakes int           // concurrent in-handshake conns
+	Backoff       time.Duration // told to rejected servers, default 5s
+}
+
+type limits struct {
+	limits Limits
+}
+
+// WithLimits set the admission limits of the client, the source ip is of
+// the PROXY protocol header if any
+func WithLimits(l Limits) ClientOpt {
+	return &limits{limits: l}
+}
+func (o *limits) applyClient(co *clientOpts) {
+	co.limits = o.limits
+	if co.limits.Burst <= 0 {
+		co.limits.Burst = int(math.Ceil(co.limits.Rate))
+	}
+	if co.limits.Backoff <= 0 {
+		co.limits.Backoff = defaultRejectBackoff
+	}
+}
+
+// bucket is the token bucket of registrations from a source ip
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// fill refill the bucket at rate up to burst
+func (b *bucket) fill(now time.Time, rate float64, burst int) {
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.last = now
+}
+
+// allowRate take a token of the source ip of addr, c.statsMu should be held
+func (c *Client) allowRate(addr net.Addr) bool {
+	if c.limits.Rate <= 0 {
+		return true
+	}
+
+	ip := addrIP(addr).String()
+	now := time.Now()
+	b, ok := c.buckets[ip]
+	if !ok {
+		b = &bucket{tokens: float64(c.limits.Burst), last: now}
+		c.buckets[ip] = b
+	}
+	b.fill(now, c.limits.Rate, c.limits.Burst)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// gcBuckets forget the source ips whose bucket is full again
+func (c *Client) gcBuckets() {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+
+	now := time.Now()
+	for ip, b := range c.buckets {
+		if b.fill(now, c.limits.Rate, c.limits.Burst); b.tokens >= float64(c.limits.Burst) {
+			delete(c.buckets, ip)
+		}
+	}
+}
+
+// track count a conn accepted from a server until it is closed, false if
+// there are too many conns in handshake
+func (c *Client) track(conn net.Conn) (*trackedConn, bool) {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+
+	if c.limits.MaxHandshakes > 0 && c.handshakes >= c.limits.MaxHandshakes {
+		return nil, false
+	}
+	c.conns++
+	c.handshakes++
+	return &trackedConn{Conn: conn, client: c}, true
+}
+
+// handshaked count the end of a handshake
+func (c *Client) handshaked() {
+	c.statsMu.Lock()
+	c.handshakes--
+	c.statsMu.Unlock()
+}
+
+// trackedConn is a conn counted by Limits.MaxConns
+type trackedConn struct {
+	net.Conn
+	client *Client
+	once   sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() {
+		c.client.statsMu.Lock()
+		c.client.conns--
+		c.client.statsMu.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+// admitConn check the rate and conn limits of a registration from addr
+func (c *Client) admitConn(addr net.Addr, h *hello) error {
+	c.statsMu.Lock()
+	allowed := c.allowRate(addr)
+	conns := c.conns
+	c.statsMu.Unlock()
+
+	if !allowed {
+		return c.rejectAll(addr, h.IDs, RejectRateLimit)
+	}
+	if c.limits.MaxConns > 0 && conns > c.limits.MaxConns {
+		return c.rejectAll(addr, h.IDs, RejectConnLimit)
+	}
+	return nil
+}
+
+// admitIdle check the idle limit of a data conn registered from addr, it is
+// rejected once all its ids have enough idle conns
+func (c *Client) admitIdle(addr net.Addr, h *hello) error {
+	if h.Kind != kindData || c.limits.MaxIdlePerID <= 0 {
+		return nil
+	}
+	for _, id := range h.IDs {
+		val, ok := c.Load(id)
+		if !ok || val.(*pool).Idle() < c.limits.MaxIdlePerID {
+			return nil
+		}
+	}
+	return c.rejectAll(addr, h.IDs, RejectIdleLimit)
+}
+
+// rejectAll reject the registration of ids from addr
+func (c *Client) rejectAll(addr net.Addr, ids []string, reason string) error {
+	for _, id := range ids {
+		c.reject(addr, id, reason)
+	}
+	return &rejectError{reason: reason, backoff: c.backoff()}
+}
+
+// backoff return how long a rejected server should wait
+func (c *Client) backoff() time.Duration {
+	if c.limits.Backoff <= 0 {
+		return defaultRejectBackoff
+	}
+	return c.limits.Backoff
+}
@@ -0,0 +1,105 @@
+package pgrpc_test
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/wweir/pgrpc"
+)
+
+// register send a hello for id on a new conn to addr like a server, and
+// return the conn with the ack payload
+func register(t *testing.T, addr, id string) (net.Conn, string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	writeHello(t, conn, map[string]interface{}{"id": id, "kind": "data", "session": "limits"})
+	typ, payload, err := readFrame(conn)
+	if err != nil || typ != 0x86 {
+		t.Fatalf("unexpected hello ack: %#x %s %v", typ, payload, err)
+	}
+	return conn, string(payload)
+}
+
+func Test_WithLimits(t *testing.T) {
+	t.Run("rate", func(t *testing.T) {
+		// the burst defaults to the rate rounded up
+		c, addr := newClient(t, pgrpc.WithLimits(pgrpc.Limits{Rate: 1.5, Backoff: 3 * time.Second}))
+		for i := 0; i < 2; i++ {
+			conn, ack := register(t, addr, "rate")
+			defer conn.Close()
+			if ack != "{}" {
+				t.Fatalf("%d: unexpected ack: %s", i, ack)
+			}
+		}
+
+		conn, ack := register(t, addr, "rate")
+		defer conn.Close()
+		if ack != `{"reject":"rate_limit","backoff":3000}` {
+			t.Fatalf("unexpected ack: %s", ack)
+		}
+		if data, err := ioutil.ReadAll(conn); err != nil || len(data) != 0 {
+			t.Fatalf("rejected conn not closed: %q, %v", data, err)
+		}
+		if n := c.Stats().Rejected[pgrpc.RejectRateLimit]; n != 1 {
+			t.Fatalf("unexpected rejected count: %d", n)
+		}
+	})
+
+	t.Run("conns", func(t *testing.T) {
+		c, addr := newClient(t, pgrpc.WithLimits(pgrpc.Limits{MaxConns: 2}))
+		for i := 0; i < 2; i++ {
+			conn, ack := register(t, addr, "conns")
+			defer conn.Close()
+			if ack != "{}" {
+				t.Fatalf("%d: unexpected ack: %s", i, ack)
+			}
+		}
+
+		conn, ack := register(t, addr, "conns")
+		conn.Close()
+		if ack != `{"reject":"conn_limit","backoff":5000}` {
+			t.Fatalf("unexpected ack: %s", ack)
+		}
+		waitFor(t, "the rejected conn to close", func() bool { return c.Stats().Conns == 2 })
+		if n := c.Stats().Rejected[pgrpc.RejectConnLimit]; n != 1 {
+			t.Fatalf("unexpected rejected count: %d", n)
+		}
+	})
+
+	t.Run("handshakes", func(t *testing.T) {
+		c, addr := newClient(t, pgrpc.WithLimits(pgrpc.Limits{MaxHandshakes: 1}))
+
+		// a conn in handshake until it sends a hello
+		slow, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer slow.Close()
+		waitFor(t, "the handshake", func() bool { return c.Stats().Handshakes == 1 })
+
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if data, err := ioutil.ReadAll(conn); err != nil || len(data) != 0 {
+			t.Fatalf("conn over the handshake limit not closed: %q, %v", data, err)
+		}
+		if n := c.Stats().Rejected[pgrpc.RejectHandshakeLimit]; n != 1 {
+			t.Fatalf("unexpected rejected count: %d", n)
+		}
+
+		writeHello(t, slow, map[string]interface{}{"id": "slow", "kind": "data", "session": "limits"})
+		waitServer(t, c, "slow")
+		if stats := c.Stats(); stats.Handshakes != 0 || stats.Conns != 1 {
+			t.Fatalf("unexpected stats: %+v", stats)
+		}
+	})
+}
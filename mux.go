@@ -0,0 +1,33 @@
+package pgrpc
+
+import (
+	"bytes"
+
+	"github.com/hashicorp/yamux"
+)
+
+type muxOpt struct{}
+
+// WithMux multiplex all conns over a single reverse tcp conn to the client,
+// every conn taken by the client is a logical stream with its own flow
+// control. It is useful while NAT devices limit concurrent flows per host.
+func WithMux() ServerOpt {
+	return &muxOpt{}
+}
+func (o *muxOpt) applyServer(so *serverOpts) {
+	so.mux = true
+}
+
+func muxConfig(log func(string, ...interface{})) *yamux.Config {
+	config := yamux.DefaultConfig()
+	config.LogOutput = logWriter(log)
+	return config
+}
+
+// logWriter redirect yamux logs to the pgrpc logger
+type logWriter func(string, ...interface{})
+
+func (w logWriter) Write(p []byte) (int, error) {
+	w("%s", bytes.TrimSpace(p))
+	return len(p), nil
+}
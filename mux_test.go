@@ -0,0 +1,65 @@
+package pgrpc_test
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/wweir/pgrpc"
+)
+
+func Test_WithMux(t *testing.T) {
+	var accepted int32
+	c, addr := newClient(t, pgrpc.WithAcceptHook(func(conn net.Conn) (net.Conn, error) {
+		atomic.AddInt32(&accepted, 1)
+		return conn, nil
+	}))
+
+	sess, err := pgrpc.NewSession(addr, pgrpc.WithMux())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	ln, err := sess.Listen("mux-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serveEcho(ln)
+	waitServer(t, c, "mux-a")
+
+	// an id registered later is served over the control stream
+	ln2, err := sess.Listen("mux-b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go serveEcho(ln2)
+	waitServer(t, c, "mux-b")
+
+	var conns []net.Conn
+	for i := 0; i < 10; i++ {
+		id := []string{"mux-a", "mux-b"}[i%2]
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		conn, err := c.DialConn(ctx, id)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		echo(t, conn, "over a stream of "+id)
+		conns = append(conns, conn)
+	}
+
+	if n := atomic.LoadInt32(&accepted); n != 1 {
+		t.Errorf("unexpected tcp conns: %d", n)
+	}
+	if stats := ln.Stats(); stats.Activated != 5 || stats.Active != 5 || stats.Dialing != 0 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+	waitFor(t, "streams to close", func() bool { return ln.Stats().Active == 0 && ln2.Stats().Active == 0 })
+}
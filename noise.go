@@ -0,0 +1,288 @@
+package pgrpc
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"path"
+	"sync"
+
+	"github.com/flynn/noise"
+	"github.com/pkg/errors"
+)
+
+// reason of a RejectEvent by WithNoise
+const (
+	RejectNoise   = "noise"    // noise handshake fails, eg: the key is not allowed
+	RejectNoiseID = "noise_id" // id is not bound to the noise key of the server
+)
+
+const (
+	noiseKeyLen = 32
+	// noiseMaxPlain is the max plaintext in a noise message, which is at most
+	// 65535 bytes including the 16 bytes tag
+	noiseMaxPlain = 65535 - 16
+)
+
+var (
+	noiseSuite    = noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashBLAKE2s)
+	noisePrologue = []byte("pgrpc")
+)
+
+// NoiseKey is a static Curve25519 keypair of a noise peer
+type NoiseKey struct {
+	Private, Public []byte
+}
+
+// GenerateNoiseKey generate a random NoiseKey
+func GenerateNoiseKey() (NoiseKey, error) {
+	key, err := noiseSuite.GenerateKeypair(rand.Reader)
+	if err != nil {
+		return NoiseKey{}, err
+	}
+	return NoiseKey{Private: key.Private, Public: key.Public}, nil
+}
+
+// NoisePeer is a peer allowed by its static public key. On the client, the
+// server with the key may only register the ids matching the path.Match
+// patterns of IDs, any id if empty.
+type NoisePeer struct {
+	Public []byte
+	IDs    []string
+}
+
+// allow report whether the peer may register id
+func (p *NoisePeer) allow(id string) bool {
+	if len(p.IDs) == 0 {
+		return true
+	}
+	for _, pattern := range p.IDs {
+		if ok, _ := path.Match(pattern, id); ok {
+			return true
+		}
+	}
+	return false
+}
+
+type noiseConfig struct {
+	key   noise.DHKey
+	peers []NoisePeer
+}
+
+// peer return the allowed peer of the public key, nil if not allowed
+func (cfg *noiseConfig) peer(public []byte) *NoisePeer {
+	for i := range cfg.peers {
+		if bytes.Equal(cfg.peers[i].Public, public) {
+			return &cfg.peers[i]
+		}
+	}
+	return nil
+}
+
+type noiseOpt struct {
+	key   NoiseKey
+	peers []NoisePeer
+}
+
+// WithNoise encrypt and mutually authenticate the conns between the server and
+// the client by the Noise XX handshake, instead of a PKI. Each side has a
+// static key, and only accepts the peers of the listed public keys. It runs
+// after accept hooks and before tls, if any. The server is the initiator on
+// both reverse and direct conns.
+func WithNoise(key NoiseKey, peers ...NoisePeer) *noiseOpt {
+	return &noiseOpt{key: key, peers: peers}
+}
+func (o *noiseOpt) config() (*noiseConfig, error) {
+	if len(o.key.Private) != noiseKeyLen || len(o.key.Public) != noiseKeyLen {
+		return nil, errors.New("invalid noise key")
+	}
+	if len(o.peers) == 0 {
+		return nil, errors.New("no noise peer")
+	}
+	for _, p := range o.peers {
+		if len(p.Public) != noiseKeyLen {
+			return nil, errors.Errorf("invalid noise peer key: %x", p.Public)
+		}
+		for _, pattern := range p.IDs {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, errors.Wrapf(err, "invalid id pattern %q", pattern)
+			}
+		}
+	}
+
+	key := noise.DHKey{Private: o.key.Private, Public: o.key.Public}
+	return &noiseConfig{key: key, peers: o.peers}, nil
+}
+func (o *noiseOpt) applyClient(co *clientOpts) {
+	cfg, err := o.config()
+	if err != nil {
+		co.err = err
+		return
+	}
+	co.noise = cfg
+}
+func (o *noiseOpt) applyServer(so *serverOpts) {
+	cfg, err := o.config()
+	if err != nil {
+		so.err = err
+		return
+	}
+	so.noise = cfg
+}
+
+// noiseHandshake run the XX handshake on conn, the peer static key should be
+// allowed by cfg
+func noiseHandshake(conn net.Conn, cfg *noiseConfig, initiator bool) (*noiseConn, error) {
+	hs, err := noise.NewHandshakeState(noise.Config{
+		CipherSuite:   noiseSuite,
+		Random:        rand.Reader,
+		Pattern:       noise.HandshakeXX,
+		Initiator:     initiator,
+		Prologue:      noisePrologue,
+		StaticKeypair: cfg.key,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// -> e; <- e, ee, s, es; -> s, se
+	var cs1, cs2 *noise.CipherState
+	var peer *NoisePeer
+	for i := 0; i < 3; i++ {
+		if (i%2 == 0) == initiator {
+			var msg []byte
+			if msg, cs1, cs2, err = hs.WriteMessage(nil, nil); err != nil {
+				return nil, errors.Wrap(err, "write noise handshake")
+			}
+			if err := writeNoiseMsg(conn, msg); err != nil {
+				return nil, errors.Wrap(err, "write noise handshake")
+			}
+		} else {
+			msg, err := readNoiseMsg(conn)
+			if err != nil {
+				return nil, errors.Wrap(err, "read noise handshake")
+			}
+			if _, cs1, cs2, err = hs.ReadMessage(nil, msg); err != nil {
+				return nil, errors.Wrap(err, "read noise handshake")
+			}
+		}
+
+		// the static key of the peer is known once read
+		if peer == nil && hs.PeerStatic() != nil {
+			if peer = cfg.peer(hs.PeerStatic()); peer == nil {
+				return nil, errors.Errorf("noise peer not allowed: %s",
+					base64.StdEncoding.EncodeToString(hs.PeerStatic()))
+			}
+		}
+	}
+
+	nc := &noiseConn{Conn: conn, peer: peer, enc: cs1, dec: cs2}
+	if !initiator {
+		nc.enc, nc.dec = cs2, cs1
+	}
+	return nc, nil
+}
+
+func writeNoiseMsg(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := w.Write(buf)
+	return err
+}
+
+func readNoiseMsg(r io.Reader) ([]byte, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// noiseConn is a conn encrypted by noise transport messages
+type noiseConn struct {
+	net.Conn
+	peer *NoisePeer
+
+	rmu sync.Mutex
+	dec *noise.CipherState
+	buf []byte // decrypted, not read yet
+
+	wmu sync.Mutex
+	enc *noise.CipherState
+}
+
+func (c *noiseConn) Read(p []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	for len(c.buf) == 0 {
+		msg, err := readNoiseMsg(c.Conn)
+		if err != nil {
+			return 0, err
+		}
+		if c.buf, err = c.dec.Decrypt(msg[:0], nil, msg); err != nil {
+			return 0, errors.Wrap(err, "noise decrypt")
+		}
+	}
+
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func (c *noiseConn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	var written int
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > noiseMaxPlain {
+			chunk = chunk[:noiseMaxPlain]
+		}
+
+		buf := make([]byte, 2, 2+len(chunk)+16)
+		buf, err := c.enc.Encrypt(buf, nil, chunk)
+		if err != nil {
+			return written, errors.Wrap(err, "noise encrypt")
+		}
+		binary.BigEndian.PutUint16(buf, uint16(len(buf)-2))
+		if _, err := c.Conn.Write(buf); err != nil {
+			return written, err
+		}
+
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// identity return the public key of the peer
+func (c *noiseConn) identity() string {
+	return "noise:" + base64.StdEncoding.EncodeToString(c.peer.Public)
+}
+
+// admitNoise remove the ids of hello not bound to the noise key of the server
+func (c *Client) admitNoise(addr net.Addr, h *hello) error {
+	ids := h.IDs[:0]
+	for _, id := range h.IDs {
+		if h.noisePeer.allow(id) {
+			ids = append(ids, id)
+		} else {
+			c.reject(addr, id, RejectNoiseID)
+		}
+	}
+	h.IDs = ids
+	if len(ids) == 0 {
+		return &rejectError{reason: RejectNoiseID, backoff: c.backoff()}
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package pgrpc_test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/wweir/pgrpc"
+)
+
+func Test_WithNoise(t *testing.T) {
+	serverKey, _ := pgrpc.GenerateNoiseKey()
+	clientKey, _ := pgrpc.GenerateNoiseKey()
+	otherKey, _ := pgrpc.GenerateNoiseKey()
+
+	for _, tc := range []struct {
+		name   string
+		key    pgrpc.NoiseKey // of the server
+		id     string
+		reject string
+	}{
+		{"allowed", serverKey, "store-1", ""},
+		{"id not bound", serverKey, "web", pgrpc.RejectNoiseID},
+		{"key not allowed", otherKey, "store-1", pgrpc.RejectNoise},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, addr := newClient(t, pgrpc.WithNoise(clientKey,
+				pgrpc.NoisePeer{Public: serverKey.Public, IDs: []string{"store-*"}}))
+			ln, err := pgrpc.Listen(addr, tc.id, pgrpc.WithNoise(tc.key, pgrpc.NoisePeer{Public: clientKey.Public}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			go serveEcho(ln)
+
+			if tc.reject != "" {
+				waitFor(t, "the rejection", func() bool { return c.Stats().Rejected[tc.reject] != 0 })
+				if servers := c.Servers(tc.id); len(servers) != 0 {
+					t.Fatalf("%s registered: %+v", tc.id, servers)
+				}
+				return
+			}
+
+			waitServer(t, c, tc.id)
+			conn, err := c.DialConn(context.Background(), tc.id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			// over a noise message
+			echo(t, conn, strings.Repeat("pgrpc", 30000))
+		})
+	}
+
+	for _, opt := range []pgrpc.ClientOpt{
+		pgrpc.WithNoise(clientKey),
+		pgrpc.WithNoise(clientKey, pgrpc.NoisePeer{Public: serverKey.Public, IDs: []string{"["}}),
+		pgrpc.WithNoise(pgrpc.NoiseKey{}, pgrpc.NoisePeer{Public: serverKey.Public}),
+		pgrpc.WithNoise(clientKey, pgrpc.NoisePeer{Public: bytes.Repeat([]byte{1}, 16)}),
+	} {
+		if _, err := pgrpc.NewClient("127.0.0.1:0", opt); err == nil {
+			t.Errorf("invalid option %#v accepted", opt)
+		}
+	}
+}
@@ -1,5 +1,19 @@
 package pgrpc
 
+import (
+	"crypto/tls"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultHandshakeTimeout = 5 * time.Second
+	defaultPingInterval     = 20 * time.Second
+	defaultKeepAlive        = 5 * time.Second
+)
+
 type logger struct {
 	log func(string, ...interface{})
 }
@@ -19,3 +33,123 @@ func (o *logger) applyClient(co *clientOpts) {
 func (o *logger) applyServer(so *serverOpts) {
 	so.log = o.log
 }
+
+type acceptHook struct {
+	fn func(net.Conn) (net.Conn, error)
+}
+
+// WithAcceptHook add a middleware for every new tcp conn, it runs in order
+// before the pgrpc handshake. The client runs it on accepted conns, and the
+// server runs it on dialed conns.
+func WithAcceptHook(fn func(net.Conn) (net.Conn, error)) *acceptHook {
+	return &acceptHook{fn: fn}
+}
+func (o *acceptHook) applyClient(co *clientOpts) {
+	co.onAccept = append(co.onAccept, o.fn)
+}
+func (o *acceptHook) applyServer(so *serverOpts) {
+	so.onAccept = append(so.onAccept, o.fn)
+}
+
+type handshakeTimeout struct {
+	timeout time.Duration
+}
+
+// WithHandshakeTimeout set the timeout of the pgrpc handshake, including the
+// tls handshake, default 5s
+func WithHandshakeTimeout(timeout time.Duration) *handshakeTimeout {
+	return &handshakeTimeout{timeout: timeout}
+}
+func (o *handshakeTimeout) applyClient(co *clientOpts) {
+	co.handshakeTimeout = o.timeout
+}
+func (o *handshakeTimeout) applyServer(so *serverOpts) {
+	so.handshakeTimeout = o.timeout
+}
+
+type keepAlive struct {
+	period time.Duration
+}
+
+// WithKeepAlive set the tcp keepalive period of reverse and direct conns,
+// default 5s. A negative period disables it, 0 leaves the keepalive of the
+// listener or dialer as is, eg: 15s by go.
+func WithKeepAlive(period time.Duration) *keepAlive {
+	return &keepAlive{period: period}
+}
+func (o *keepAlive) applyClient(co *clientOpts) {
+	co.keepAlive = o.period
+}
+func (o *keepAlive) applyServer(so *serverOpts) {
+	so.keepAlive = o.period
+}
+
+type pingInterval struct {
+	interval time.Duration
+}
+
+// WithPingInterval set how often the client pings idle reverse conns, default
+// 20s, which keeps NAT mappings alive. The client drops a conn missing a pong
+// in an interval, and the server drops a conn missing pings in 3 intervals.
+// It should be positive.
+func WithPingInterval(interval time.Duration) *pingInterval {
+	return &pingInterval{interval: interval}
+}
+func (o *pingInterval) applyClient(co *clientOpts) {
+	if o.interval <= 0 {
+		co.err = errors.Errorf("invalid ping interval: %s", o.interval)
+		return
+	}
+	co.pingInterval = o.interval
+}
+func (o *pingInterval) applyServer(so *serverOpts) {
+	if o.interval <= 0 {
+		so.err = errors.Errorf("invalid ping interval: %s", o.interval)
+		return
+	}
+	so.pingInterval = o.interval
+}
+
+type idlePool struct {
+	min, max int
+}
+
+// WithIdlePool set the idle pool size, default MIN_IDLE and MAX_IDLE. The
+// server keeps min to max idle conns dialed to the client, the client caches
+// at most max-min idle grpc ClientConns for every server. With min 0, the
+// server dials only while the client asks for conns.
+func WithIdlePool(min, max int) *idlePool {
+	if min < 0 {
+		min = 0
+	}
+	if max < 1 {
+		max = 1
+	}
+	if max < min {
+		max = min
+	}
+	return &idlePool{min: min, max: max}
+}
+func (o *idlePool) applyClient(co *clientOpts) {
+	co.minIdle, co.maxIdle = o.min, o.max
+}
+func (o *idlePool) applyServer(so *serverOpts) {
+	so.minIdle, so.maxIdle = o.min, o.max
+}
+
+type tlsConfig struct {
+	config *tls.Config
+}
+
+// WithTLSConfig secure the reverse conns with tls. The client is the tls
+// server, and the server is the tls client, whose ServerName defaults to the
+// host of the client address.
+func WithTLSConfig(config *tls.Config) *tlsConfig {
+	return &tlsConfig{config: config}
+}
+func (o *tlsConfig) applyClient(co *clientOpts) {
+	co.tlsConfig = o.config
+}
+func (o *tlsConfig) applyServer(so *serverOpts) {
+	so.tlsConfig = o.config
+}
@@ -0,0 +1,177 @@
+package pgrpc_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/wweir/pgrpc"
+)
+
+// selfSigned return a self-signed certificate of 127.0.0.1, and a pool
+// trusting it
+func selfSigned(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "pgrpc"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func Test_ServerOpts(t *testing.T) {
+	cert, roots := selfSigned(t)
+	c, addr := newClient(t, pgrpc.WithTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}}))
+
+	var dialed, hooked int32
+	ln, err := pgrpc.Listen(addr, "opts",
+		pgrpc.WithTLSConfig(&tls.Config{RootCAs: roots}),
+		pgrpc.WithIdlePool(2, 4),
+		pgrpc.WithHandshakeTimeout(time.Second),
+		pgrpc.WithDialer(func(ctx context.Context, network, address string) (net.Conn, error) {
+			atomic.AddInt32(&dialed, 1)
+			return (&net.Dialer{}).DialContext(ctx, network, address)
+		}),
+		pgrpc.WithAcceptHook(func(conn net.Conn) (net.Conn, error) {
+			atomic.AddInt32(&hooked, 1)
+			return conn, nil
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go serveEcho(ln)
+	waitServer(t, c, "opts")
+
+	stats := ln.(*pgrpc.Listener).Stats
+	waitFor(t, "the idle pool to fill", func() bool { return stats().Idle >= 2 })
+
+	conn, err := c.DialConn(context.Background(), "opts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	echo(t, conn, "hello over tls")
+
+	if stats().Active != 1 {
+		t.Errorf("unexpected stats: %+v", stats())
+	}
+	// conns being dialed are not hooked yet
+	hooks, dials := atomic.LoadInt32(&hooked), atomic.LoadInt32(&dialed)
+	if hooks < 3 || dials < hooks {
+		t.Errorf("unexpected dialed %d, hooked %d", dials, hooks)
+	}
+}
+
+func Test_WithHandshakeTimeout(t *testing.T) {
+	// a client that accepts conns and never answers the handshake
+	mute, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mute.Close()
+
+	ln, err := pgrpc.Listen(mute.Addr().String(), "mute", pgrpc.WithHandshakeTimeout(200*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	conn, err := mute.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	conn.SetReadDeadline(start.Add(5 * time.Second))
+	if _, err := io.Copy(ioutil.Discard, conn); err != nil {
+		t.Fatalf("conn not closed by the server: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("handshake timeout after %s", elapsed)
+	}
+}
+
+func Test_Ping(t *testing.T) {
+	const interval = 50 * time.Millisecond
+	for _, tc := range []struct {
+		name     string
+		opts     []pgrpc.ClientOpt
+		recycled bool
+	}{
+		{"pinged", []pgrpc.ClientOpt{pgrpc.WithPingInterval(interval)}, false},
+		// the client pings every 30s, too late for the server
+		{"not pinged", nil, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, addr := newClient(t, tc.opts...)
+			ln, err := pgrpc.Listen(addr, "ping",
+				pgrpc.WithIdlePool(1, 1), pgrpc.WithPingInterval(interval))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			go serveEcho(ln)
+			waitServer(t, c, "ping")
+
+			// the server recycles idle conns missing pings for 3 intervals
+			stats := ln.(*pgrpc.Listener).Stats
+			waitFor(t, "the idle conn", func() bool { return stats().Idle == 1 })
+			time.Sleep(10 * interval)
+			if recycled := stats().Dialed > 1; recycled != tc.recycled {
+				t.Fatalf("unexpected stats: %+v", stats())
+			}
+			if tc.recycled {
+				return
+			}
+
+			conn, err := c.DialConn(context.Background(), "ping")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			echo(t, conn, "hello after pings")
+		})
+	}
+}
+
+func Test_WithPingInterval(t *testing.T) {
+	for _, interval := range []time.Duration{0, -time.Second} {
+		if _, err := pgrpc.NewClient("127.0.0.1:0", pgrpc.WithPingInterval(interval)); err == nil {
+			t.Errorf("client accepts ping interval %s", interval)
+		}
+		if _, err := pgrpc.NewSession("127.0.0.1:1", pgrpc.WithPingInterval(interval)); err == nil {
+			t.Errorf("server accepts ping interval %s", interval)
+		}
+	}
+}
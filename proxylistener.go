@@ -0,0 +1,179 @@
+package pgrpc
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ProxyAction is how a PROXY header from an untrusted peer is handled
+type ProxyAction int
+
+const (
+	ProxyReject ProxyAction = iota // close the conn
+	ProxyIgnore                    // strip the header, keep the peer address
+)
+
+// ProxyPolicy decide which peers may send a PROXY header, eg: the load
+// balancers in front of the client
+type ProxyPolicy struct {
+	Trusted   []string      // IPs or CIDRs of trusted peers
+	Require   bool          // trusted peers must send a header
+	Untrusted ProxyAction   // for headers from the other peers
+	Timeout   time.Duration // header read timeout, default the handshake timeout
+}
+
+// proxyChecker parse PROXY headers by a policy, a nil policy trusts all peers
+type proxyChecker struct {
+	policy  *ProxyPolicy
+	trusted []*net.IPNet
+	log     func(string, ...interface{})
+}
+
+func newProxyChecker(policy *ProxyPolicy, log func(string, ...interface{})) (*proxyChecker, error) {
+	checker := &proxyChecker{policy: policy, log: log}
+	if policy == nil {
+		return checker, nil
+	}
+
+	var err error
+	if checker.trusted, err = parseNets(policy.Trusted); err != nil {
+		return nil, errors.Wrap(err, "invalid trusted proxy")
+	}
+	return checker, nil
+}
+
+// parse read the PROXY header of conn in timeout, unless the policy sets one
+func (pc *proxyChecker) parse(conn net.Conn, timeout time.Duration) (net.Conn, error) {
+	if pc.policy != nil && pc.policy.Timeout > 0 {
+		timeout = pc.policy.Timeout
+	}
+	peer := conn.RemoteAddr()
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	c, hdr, err := ParseProxyHeader(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil || pc.policy == nil {
+		return c, err
+	}
+
+	trusted := netsContain(pc.trusted, addrIP(peer))
+	switch {
+	case trusted && hdr == nil && pc.policy.Require:
+		return c, errors.Errorf("no proxy header from trusted peer %s", peer)
+	case !trusted && hdr != nil && pc.policy.Untrusted == ProxyReject:
+		return c, errors.Errorf("proxy header from untrusted peer %s", peer)
+	case !trusted && hdr != nil:
+		if pc.log != nil {
+			pc.log("ignore proxy header from untrusted peer %s", peer)
+		}
+		c.(*proxyConn).hdr = nil
+	}
+	return c, nil
+}
+
+// ProxyListener is a net.Listener whose conns may start with a PROXY protocol
+// header, eg: behind a load balancer. The header is parsed lazily on the
+// first Read, RemoteAddr or LocalAddr call of a conn, so a slow peer never
+// blocks Accept. A conn with an invalid header, or rejected by the policy, is
+// closed with the error on Read.
+type ProxyListener struct {
+	net.Listener
+	checker *proxyChecker
+	timeout time.Duration
+}
+
+// NewProxyListener wrap ln, a nil policy trusts headers from all peers. The
+// header read timeout defaults to 5s.
+func NewProxyListener(ln net.Listener, policy *ProxyPolicy) (*ProxyListener, error) {
+	checker, err := newProxyChecker(policy, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &ProxyListener{Listener: ln, checker: checker, timeout: defaultHandshakeTimeout}, nil
+}
+
+func (ln *ProxyListener) Accept() (net.Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &lazyProxyConn{Conn: conn, ln: ln}, nil
+}
+
+// lazyProxyConn parse the PROXY header on first use, writes go to the raw
+// conn directly. Read deadlines set before are kept after the header is read.
+type lazyProxyConn struct {
+	net.Conn // raw
+	ln       *ProxyListener
+
+	once   sync.Once
+	parsed net.Conn // after the header, or the raw conn on error
+	err    error
+
+	mu       sync.Mutex
+	deadline time.Time // read deadline set by the user
+}
+
+func (c *lazyProxyConn) parse() net.Conn {
+	c.once.Do(func() {
+		c.mu.Lock()
+		deadline := c.deadline
+		c.mu.Unlock()
+
+		timeout := c.ln.timeout
+		if !deadline.IsZero() {
+			if d := time.Until(deadline); d < timeout {
+				timeout = d
+			}
+		}
+
+		c.parsed, c.err = c.ln.checker.parse(c.Conn, timeout)
+		c.Conn.SetReadDeadline(deadline)
+		if c.err != nil {
+			c.parsed = c.Conn
+			c.Conn.Close()
+		}
+	})
+	return c.parsed
+}
+
+func (c *lazyProxyConn) Read(b []byte) (int, error) {
+	conn := c.parse()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return conn.Read(b)
+}
+
+func (c *lazyProxyConn) RemoteAddr() net.Addr {
+	return c.parse().RemoteAddr()
+}
+
+func (c *lazyProxyConn) LocalAddr() net.Addr {
+	return c.parse().LocalAddr()
+}
+
+// ProxyHeader return the PROXY protocol header of the conn, nil if none
+func (c *lazyProxyConn) ProxyHeader() *ProxyHeader {
+	if conn, ok := c.parse().(*proxyConn); ok {
+		return conn.hdr
+	}
+	return nil
+}
+
+func (c *lazyProxyConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *lazyProxyConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return c.Conn.SetReadDeadline(t)
+}
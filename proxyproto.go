@@ -1,9 +1,14 @@
 package pgrpc
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/binary"
+	"hash/crc32"
 	"io"
 	"net"
+	"strconv"
+	"strings"
 
 	"github.com/pkg/errors"
 )
@@ -17,155 +22,726 @@ var space = []byte(" ")
 // "PROXY UNKNOWN ffff:f...f:ffff ffff:f...f:ffff 65535 65535\r\n"
 const maximumLenV1 = 107
 
-// signature(12)+ver_cmd(1)+fam(1)+len(2)+socketX2(216)
-const maximumLenV2 = 232
-
 // V1 "PROXY UNKNOW" or V2 signature
 const signatureLen = 12
 
+// the uint16 length of the v2 addresses and TLVs, and of a TLV value
+const maximumLenV2 = 1<<16 - 1
+
+// ProxyCommand is the command of a PROXY protocol v2 header, v1 headers are
+// always ProxyCommandProxy
+type ProxyCommand byte
+
+const (
+	ProxyCommandLocal ProxyCommand = 0x0 // health check of the proxy, addresses are ignored
+	ProxyCommandProxy ProxyCommand = 0x1 // conn relayed on behalf of another node
+)
+
+// ProxyTransport is the address family and transport protocol of a PROXY
+// protocol header, in the v2 byte format
+type ProxyTransport byte
+
+const (
+	ProxyTransportUnspec   ProxyTransport = 0x00 // v1 UNKNOWN
+	ProxyTransportTCP4     ProxyTransport = 0x11
+	ProxyTransportUDP4     ProxyTransport = 0x12
+	ProxyTransportTCP6     ProxyTransport = 0x21
+	ProxyTransportUDP6     ProxyTransport = 0x22
+	ProxyTransportUnix     ProxyTransport = 0x31 // stream
+	ProxyTransportUnixgram ProxyTransport = 0x32
+)
+
+// PROXY protocol v2 TLV types
+const (
+	ProxyTLVALPN      byte = 0x01
+	ProxyTLVAuthority byte = 0x02
+	ProxyTLVCRC32C    byte = 0x03
+	ProxyTLVNoop      byte = 0x04
+	ProxyTLVUniqueID  byte = 0x05
+	ProxyTLVSSL       byte = 0x20
+	ProxyTLVNetNS     byte = 0x30
+
+	// sub-TLVs of ProxyTLVSSL
+	ProxyTLVSSLVersion byte = 0x21
+	ProxyTLVSSLCN      byte = 0x22
+	ProxyTLVSSLCipher  byte = 0x23
+	ProxyTLVSSLSigAlg  byte = 0x24
+	ProxyTLVSSLKeyAlg  byte = 0x25
+)
+
+// ProxyTLV is a type-length-value of a PROXY protocol v2 header
+type ProxyTLV struct {
+	Type  byte
+	Value []byte
+}
+
+// ProxyHeader is a PROXY protocol header, TLVs are decoded into fields, and
+// kept in TLVs in order as well
+type ProxyHeader struct {
+	Version     int // 1 or 2
+	Command     ProxyCommand
+	Transport   ProxyTransport
+	Source      net.Addr // nil for LOCAL or an unspecified transport
+	Destination net.Addr
+
+	TLVs      []ProxyTLV
+	ALPN      []byte
+	Authority string // host name sent by the client, eg: the tls SNI
+	CRC32C    bool   // the header carries a verified checksum
+	UniqueID  []byte // at most 128 bytes
+	SSL       *ProxySSL
+	NetNS     string
+}
+
+// ProxySSL is the decoded ProxyTLVSSL
+type ProxySSL struct {
+	Client  byte   // bit field of PP2_CLIENT_SSL, PP2_CLIENT_CERT_CONN, PP2_CLIENT_CERT_SESS
+	Verify  uint32 // 0 if the client certificate is verified
+	Version string
+	CN      string
+	Cipher  string
+	SigAlg  string
+	KeyAlg  string
+	TLVs    []ProxyTLV
+}
+
+// ParseProxyHeader read the PROXY protocol v1 or v2 header of c. The returned
+// conn reads after the header, its RemoteAddr and LocalAddr are the source
+// and destination of the header if any. The header is nil while c does not
+// start with a PROXY protocol signature, and nothing is consumed.
+func ParseProxyHeader(c net.Conn) (net.Conn, *ProxyHeader, error) {
+	return parseProxyHeader(c, true)
+}
+
+// parseProxyHeader is ParseProxyHeader, the version and command of a v2
+// header are ignored unless strict, the command is taken as PROXY
+func parseProxyHeader(c net.Conn, strict bool) (net.Conn, *ProxyHeader, error) {
+	r := bufio.NewReader(c)
+	conn := &proxyConn{Conn: c, r: r}
+
+	// compare the signatures byte by byte, so a protocol whose client sends
+	// less than a signature first is not blocked
+	var v1, v2 bool
+	for i := 1; i <= signatureLen; i++ {
+		b, err := r.Peek(i)
+		if err != nil {
+			return conn, nil, nil // read errors are left to the conn
+		}
+
+		v1 = bytes.HasPrefix(signatureV1, b) || bytes.HasPrefix(b, signatureV1)
+		v2 = bytes.HasPrefix(signatureV2, b)
+		if !v1 && !v2 {
+			return conn, nil, nil
+		}
+	}
+
+	var err error
+	if v1 {
+		conn.hdr, err = readProxyHeaderV1(r)
+	} else {
+		conn.hdr, err = readProxyHeaderV2(r, strict)
+	}
+	if err != nil {
+		return c, nil, err
+	}
+	return conn, conn.hdr, nil
+}
+
+// ParseProxyProto read the PROXY protocol header of c, and return the source
+// ip, or unix socket path. See ParseProxyHeader, unlike it the version and
+// command of a v2 header are not checked, as before ParseProxyHeader.
 func ParseProxyProto(c net.Conn) (net.Conn, string, error) {
-	buf := make([]byte, maximumLenV2)
-	if n, err := io.ReadFull(c, buf[:signatureLen]); err != nil {
-		if err == io.ErrUnexpectedEOF {
-			return &bufConn{Conn: c, buf: buf[:n], err: io.EOF}, "", nil
+	conn, hdr, err := parseProxyHeader(c, false)
+	if err != nil {
+		return nil, "", err
+	}
+	if hdr == nil {
+		return conn, "", nil
+	}
+
+	switch addr := hdr.Source.(type) {
+	case *net.TCPAddr:
+		return conn, addr.IP.String(), nil
+	case *net.UDPAddr:
+		return conn, addr.IP.String(), nil
+	case *net.UnixAddr:
+		return conn, addr.Name, nil
+	}
+	return conn, "", nil
+}
+
+// readProxyHeaderV1 read a text header:
+// "PROXY TCP4 255.255.255.255 255.255.255.255 65535 65535\r\n"
+// "PROXY TCP6 ffff:f...f:ffff ffff:f...f:ffff 65535 65535\r\n"
+// "PROXY UNKNOWN\r\n"
+// "PROXY UNKNOWN ffff:f...f:ffff ffff:f...f:ffff 65535 65535\r\n"
+func readProxyHeaderV1(r *bufio.Reader) (*ProxyHeader, error) {
+	line := make([]byte, 0, maximumLenV1)
+	for !bytes.HasSuffix(line, crlf) {
+		if len(line) == maximumLenV1 {
+			return nil, errors.New("invalid proxy protocol v1: header too long")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, errors.Wrap(err, "read proxy protocol v1")
 		}
-		return &bufConn{Conn: c, buf: buf[:n], err: err}, "", nil
+		line = append(line, b)
+	}
+
+	secs := bytes.Split(line[:len(line)-len(crlf)], space)
+	if len(secs) < 2 {
+		return nil, errors.New("invalid proxy protocol v1")
 	}
 
+	hdr := &ProxyHeader{Version: 1, Command: ProxyCommandProxy}
+	switch string(secs[1]) {
+	case "TCP4":
+		hdr.Transport = ProxyTransportTCP4
+	case "TCP6":
+		hdr.Transport = ProxyTransportTCP6
+	case "UNKNOWN":
+		// the receiver must ignore the addresses
+		hdr.Transport = ProxyTransportUnspec
+		return hdr, nil
+	default:
+		return nil, errors.Errorf("invalid proxy protocol v1 transport: %s", secs[1])
+	}
+
+	if len(secs) != 6 {
+		return nil, errors.New("invalid proxy protocol v1")
+	}
+	src, err := parseProxyAddrV1(hdr.Transport, string(secs[2]), string(secs[4]))
+	if err != nil {
+		return nil, err
+	}
+	dst, err := parseProxyAddrV1(hdr.Transport, string(secs[3]), string(secs[5]))
+	if err != nil {
+		return nil, err
+	}
+	hdr.Source, hdr.Destination = src, dst
+	return hdr, nil
+}
+
+func parseProxyAddrV1(transport ProxyTransport, host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil || strings.Contains(host, ":") == (transport == ProxyTransportTCP4) {
+		return nil, errors.Errorf("invalid proxy protocol v1 address: %s", host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || (len(port) > 1 && port[0] == '0') {
+		return nil, errors.Errorf("invalid proxy protocol v1 port: %s", port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+// readProxyHeaderV2 read a binary header:
+//
+//	struct proxy_hdr_v2 {
+//	    uint8_t sig[12];  /* hex 0D 0A 0D 0A 00 0D 0A 51 55 49 54 0A */
+//	    uint8_t ver_cmd;  /* protocol version and command */
+//	    uint8_t fam;      /* protocol family and address */
+//	    uint16_t len;     /* number of following bytes part of the header */
+//	};
+//
+// followed by the addresses and TLVs
+func readProxyHeaderV2(r *bufio.Reader, strict bool) (*ProxyHeader, error) {
+	head := make([]byte, signatureLen+4)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, errors.Wrap(err, "read proxy protocol v2")
+	}
+
+	hdr := &ProxyHeader{
+		Version:   2,
+		Command:   ProxyCommand(head[12] & 0x0F),
+		Transport: ProxyTransport(head[13]),
+	}
 	switch {
-	case bytes.HasPrefix(buf, signatureV1):
-		n, idx, err := ReadSignal(c, buf[signatureLen:maximumLenV1], crlf)
-		n += signatureLen
-		idx += signatureLen
-		if err != nil {
-			return &bufConn{Conn: c, buf: buf[:n], err: err}, "", nil
+	case !strict:
+		hdr.Command = ProxyCommandProxy
+	case head[12]>>4 != 0x2:
+		return nil, errors.Errorf("invalid proxy protocol v2 version: %#x", head[12]>>4)
+	case hdr.Command != ProxyCommandLocal && hdr.Command != ProxyCommandProxy:
+		return nil, errors.Errorf("invalid proxy protocol v2 command: %#x", hdr.Command)
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(head[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, errors.Wrap(err, "read proxy protocol v2")
+	}
+
+	var addrLen int
+	switch hdr.Transport >> 4 {
+	case 0x0: // AF_UNSPEC
+	case 0x1: // AF_INET
+		// struct {        /* for TCP/UDP over IPv4, len = 12 */
+		//     uint32_t src_addr;
+		//     uint32_t dst_addr;
+		//     uint16_t src_port;
+		//     uint16_t dst_port;
+		// } ipv4_addr;
+		addrLen = 12
+	case 0x2: // AF_INET6
+		// struct {        /* for TCP/UDP over IPv6, len = 36 */
+		//      uint8_t  src_addr[16];
+		//      uint8_t  dst_addr[16];
+		//      uint16_t src_port;
+		//      uint16_t dst_port;
+		// } ipv6_addr;
+		addrLen = 36
+	case 0x3: // AF_UNIX
+		// struct {        /* for AF_UNIX sockets, len = 216 */
+		//      uint8_t src_addr[108];
+		//      uint8_t dst_addr[108];
+		// } unix_addr;
+		addrLen = 216
+	default:
+		return nil, errors.Errorf("invalid proxy protocol v2 family: %#x", hdr.Transport>>4)
+	}
+	if proto := hdr.Transport & 0x0F; proto > 0x2 {
+		return nil, errors.Errorf("invalid proxy protocol v2 transport: %#x", proto)
+	}
+	if len(payload) < addrLen {
+		return nil, errors.Errorf("invalid proxy protocol v2 length: %d", len(payload))
+	}
+
+	// the receiver must ignore the addresses of LOCAL, or an unspecified
+	// family or protocol
+	if hdr.Command == ProxyCommandProxy && addrLen > 0 && hdr.Transport&0x0F != 0 {
+		hdr.Source, hdr.Destination = parseProxyAddrV2(hdr.Transport, payload[:addrLen])
+	}
+
+	tlvs, err := parseProxyTLVs(payload[addrLen:])
+	if err != nil {
+		return nil, err
+	}
+	if err := hdr.decodeTLVs(tlvs, append(head, payload...), len(head)+addrLen); err != nil {
+		return nil, err
+	}
+	return hdr, nil
+}
+
+func parseProxyAddrV2(transport ProxyTransport, b []byte) (src, dst net.Addr) {
+	switch transport {
+	case ProxyTransportTCP4, ProxyTransportUDP4, ProxyTransportTCP6, ProxyTransportUDP6:
+		ipLen := 4
+		if transport>>4 == 0x2 {
+			ipLen = 16
 		}
+		srcIP := net.IP(append([]byte(nil), b[:ipLen]...))
+		dstIP := net.IP(append([]byte(nil), b[ipLen:2*ipLen]...))
+		srcPort := int(binary.BigEndian.Uint16(b[2*ipLen:]))
+		dstPort := int(binary.BigEndian.Uint16(b[2*ipLen+2:]))
 
-		secs := bytes.Split(buf[:idx], space)
-		if len(secs) < 2 {
-			return nil, "", errors.New("invalid proxy protocol v1")
+		if transport&0x0F == 0x2 {
+			return &net.UDPAddr{IP: srcIP, Port: srcPort}, &net.UDPAddr{IP: dstIP, Port: dstPort}
 		}
+		return &net.TCPAddr{IP: srcIP, Port: srcPort}, &net.TCPAddr{IP: dstIP, Port: dstPort}
 
-		switch string(secs[1]) {
-		case "TCP4":
-			// "PROXY TCP4 255.255.255.255 255.255.255.255 65535 65535\r\n"
-			fallthrough
-		case "TCP6":
-			// "PROXY TCP6 ffff:f...f:ffff ffff:f...f:ffff 65535 65535\r\n"
-			if len(secs) != 6 {
-				return nil, "", errors.New("invalid proxy protocol v1")
-			}
+	default: // AF_UNIX
+		network := "unix"
+		if transport == ProxyTransportUnixgram {
+			network = "unixgram"
+		}
+		return &net.UnixAddr{Name: unixPath(b[:108]), Net: network},
+			&net.UnixAddr{Name: unixPath(b[108:216]), Net: network}
+	}
+}
 
-			return &bufConn{Conn: c, buf: buf[idx+2 : n]}, string(secs[2]), nil
+func unixPath(b []byte) string {
+	if idx := bytes.IndexByte(b, 0); idx >= 0 {
+		b = b[:idx]
+	}
+	return string(b)
+}
 
-		case "UNKNOWN":
-			// "PROXY UNKNOWN\r\n"
-			// "PROXY UNKNOWN ffff:f...f:ffff ffff:f...f:ffff 65535 65535\r\n"
-			return &bufConn{Conn: c, buf: buf[idx+2 : n]}, "", nil
+// parseProxyTLVs split b into TLVs:
+//
+//	struct pp2_tlv {
+//	    uint8_t type;
+//	    uint8_t length_hi;
+//	    uint8_t length_lo;
+//	    uint8_t value[0];
+//	};
+func parseProxyTLVs(b []byte) ([]ProxyTLV, error) {
+	var tlvs []ProxyTLV
+	for len(b) != 0 {
+		if len(b) < 3 {
+			return nil, errors.New("invalid proxy protocol v2 tlv: truncated")
+		}
+		n := int(binary.BigEndian.Uint16(b[1:3]))
+		if len(b) < 3+n {
+			return nil, errors.Errorf("invalid proxy protocol v2 tlv %#x: truncated", b[0])
+		}
 
-		default:
-			return nil, "", errors.New("invalid proxy protocol v1")
-		}
-
-	case bytes.HasPrefix(buf, signatureV2):
-		// struct proxy_hdr_v2 {
-		//     uint8_t sig[12];  /* hex 0D 0A 0D 0A 00 0D 0A 51 55 49 54 0A */
-		//     uint8_t ver_cmd;  /* protocol version and command */
-		//     uint8_t fam;      /* protocol family and address */
-		//     uint16_t len;     /* number of following bytes part of the header */
-		// };
-		hdrLen := signatureLen + 4
-		n, err := io.ReadFull(c, buf[signatureLen:hdrLen])
-		n += signatureLen
-		if err != nil {
-			return &bufConn{Conn: c, buf: buf[:n], err: err}, "", nil
-		}
-
-		switch buf[13] & 0xF0 {
-		case 0x00: // AF_UNSPEC
-			//The receiver should ignore address information.
-			return &bufConn{Conn: c, buf: buf[hdrLen:n]}, "", nil
-
-		case 0x10: // AF_INET
-			// Address length is 2*4 + 2*2 = 12 bytes.
-			// struct {        /* for TCP/UDP over IPv4, len = 12 */
-			//     uint32_t src_addr;
-			//     uint32_t dst_addr;
-			//     uint16_t src_port;
-			//     uint16_t dst_port;
-			// } ipv4_addr;
-			nn, err := io.ReadFull(c, buf[hdrLen:hdrLen+12])
-			n += nn
-			if err != nil {
-				return &bufConn{Conn: c, buf: buf[:n], err: err}, "", nil
-			}
+		tlvs = append(tlvs, ProxyTLV{Type: b[0], Value: b[3 : 3+n]})
+		b = b[3+n:]
+	}
+	return tlvs, nil
+}
 
-			ip := net.IPv4(buf[16], buf[17], buf[18], buf[19]).String()
-			return c, ip, nil
-
-		case 0x20: // AF_INET6
-			// Address length is 2*16 + 2*2 = 36 bytes.
-			// struct {        /* for TCP/UDP over IPv6, len = 36 */
-			//      uint8_t  src_addr[16];
-			//      uint8_t  dst_addr[16];
-			//      uint16_t src_port;
-			//      uint16_t dst_port;
-			// } ipv6_addr;
-			nn, err := io.ReadFull(c, buf[hdrLen:hdrLen+36])
-			n += nn
-			if err != nil {
-				return &bufConn{Conn: c, buf: buf[:n], err: err}, "", nil
-			}
+// decodeTLVs decode known TLVs, the CRC32C is verified against the raw
+// header, whose TLVs start at offset
+func (hdr *ProxyHeader) decodeTLVs(tlvs []ProxyTLV, raw []byte, offset int) error {
+	hdr.TLVs = tlvs
+	for _, tlv := range tlvs {
+		offset += 3 + len(tlv.Value)
 
-			ip := net.IP(buf[16:32]).String()
-			return c, ip, nil
-
-		case 0x30: // AF_UNIX
-			// Address length is 2*108 = 216 bytes.
-			// struct {        /* for AF_UNIX sockets, len = 216 */
-			//      uint8_t src_addr[108];
-			//      uint8_t dst_addr[108];
-			// } unix_addr;
-			nn, err := io.ReadFull(c, buf[hdrLen:hdrLen+216])
-			n += nn
+		switch tlv.Type {
+		case ProxyTLVALPN:
+			hdr.ALPN = tlv.Value
+		case ProxyTLVAuthority:
+			hdr.Authority = string(tlv.Value)
+		case ProxyTLVCRC32C:
+			if len(tlv.Value) != 4 {
+				return errors.New("invalid proxy protocol v2 crc32c length")
+			}
+			if err := verifyProxyCRC32C(raw, offset-4); err != nil {
+				return err
+			}
+			hdr.CRC32C = true
+		case ProxyTLVUniqueID:
+			if len(tlv.Value) > 128 {
+				return errors.New("invalid proxy protocol v2 unique id: too long")
+			}
+			hdr.UniqueID = tlv.Value
+		case ProxyTLVSSL:
+			ssl, err := parseProxySSL(tlv.Value)
 			if err != nil {
-				return &bufConn{Conn: c, buf: buf[:n], err: err}, "", nil
+				return err
 			}
+			hdr.SSL = ssl
+		case ProxyTLVNetNS:
+			hdr.NetNS = string(tlv.Value)
+		}
+	}
+	return nil
+}
 
-			return c, string(buf[16 : 16+108]), nil
-		default:
-			return nil, "", errors.New("invalid proxy protocol v2")
+// verifyProxyCRC32C check the checksum at offset of the whole header, which is
+// calculated with the checksum field zeroed
+func verifyProxyCRC32C(raw []byte, offset int) error {
+	sum := binary.BigEndian.Uint32(raw[offset:])
+
+	buf := append([]byte(nil), raw...)
+	copy(buf[offset:offset+4], []byte{0, 0, 0, 0})
+	if crc32.Checksum(buf, crc32.MakeTable(crc32.Castagnoli)) != sum {
+		return errors.New("proxy protocol v2 crc32c mismatch")
+	}
+	return nil
+}
+
+// parseProxySSL decode a ProxyTLVSSL:
+//
+//	struct pp2_tlv_ssl {
+//	    uint8_t  client;
+//	    uint32_t verify;
+//	    struct pp2_tlv sub_tlv[0];
+//	};
+func parseProxySSL(b []byte) (*ProxySSL, error) {
+	if len(b) < 5 {
+		return nil, errors.New("invalid proxy protocol v2 ssl tlv")
+	}
+
+	tlvs, err := parseProxyTLVs(b[5:])
+	if err != nil {
+		return nil, err
+	}
+
+	ssl := &ProxySSL{Client: b[0], Verify: binary.BigEndian.Uint32(b[1:5]), TLVs: tlvs}
+	for _, tlv := range tlvs {
+		switch tlv.Type {
+		case ProxyTLVSSLVersion:
+			ssl.Version = string(tlv.Value)
+		case ProxyTLVSSLCN:
+			ssl.CN = string(tlv.Value)
+		case ProxyTLVSSLCipher:
+			ssl.Cipher = string(tlv.Value)
+		case ProxyTLVSSLSigAlg:
+			ssl.SigAlg = string(tlv.Value)
+		case ProxyTLVSSLKeyAlg:
+			ssl.KeyAlg = string(tlv.Value)
 		}
+	}
+	return ssl, nil
+}
 
-	default:
-		return &bufConn{Conn: c, buf: buf[:signatureLen]}, "", nil
+type proxyHeader struct {
+	hdr *ProxyHeader
+}
+
+// WithProxyHeader prepend a PROXY protocol header on every reverse conn
+// dialed by the server, before the tls handshake. hdr is a template: the
+// version defaults to 2, the command is always PROXY, and nil addresses are
+// the local and remote addresses of the conn, eg: the real LAN address of the
+// server behind NAT. TLVs are sent as is, eg: a ProxyTLVUniqueID.
+func WithProxyHeader(hdr *ProxyHeader) ServerOpt {
+	return &proxyHeader{hdr: hdr}
+}
+func (o *proxyHeader) applyServer(so *serverOpts) {
+	so.proxyHeader = o.hdr
+}
+
+// writeProxyHeader write the header of template to conn
+func writeProxyHeader(conn net.Conn, template *ProxyHeader) error {
+	hdr := *template
+	hdr.Command = ProxyCommandProxy
+	if hdr.Version == 0 {
+		hdr.Version = 2
+	}
+	if hdr.Source == nil {
+		hdr.Source = conn.LocalAddr()
 	}
+	if hdr.Destination == nil {
+		hdr.Destination = conn.RemoteAddr()
+	}
+
+	b, err := hdr.Format()
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(b)
+	return err
 }
 
-/**********************************************************************/
-type bufConn struct {
+// proxyConn is a conn after its PROXY protocol header
+type proxyConn struct {
 	net.Conn
-	buf    []byte
-	err    error
-	offset int
-	init   bool // read
+	r   *bufio.Reader
+	hdr *ProxyHeader
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// ProxyHeader return the PROXY protocol header of the conn, nil if none
+func (c *proxyConn) ProxyHeader() *ProxyHeader {
+	return c.hdr
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.hdr != nil && c.hdr.Source != nil {
+		return c.hdr.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	if c.hdr != nil && c.hdr.Destination != nil {
+		return c.hdr.Destination
+	}
+	return c.Conn.LocalAddr()
+}
+
+// Format encode the header, the transport is derived from the source address
+// if unspecified. Decoded TLV fields are encoded first, followed by the other
+// TLVs in TLVs, and the CRC32C last if set.
+func (hdr *ProxyHeader) Format() ([]byte, error) {
+	transport := hdr.Transport
+	if transport == ProxyTransportUnspec && hdr.Source != nil {
+		transport = proxyTransportOf(hdr.Source)
+	}
+
+	switch hdr.Version {
+	case 1:
+		return hdr.formatV1(transport)
+	case 2:
+		return hdr.formatV2(transport)
+	default:
+		return nil, errors.Errorf("invalid proxy protocol version: %d", hdr.Version)
+	}
+}
+
+func proxyTransportOf(addr net.Addr) ProxyTransport {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		if addr.IP.To4() != nil {
+			return ProxyTransportTCP4
+		}
+		return ProxyTransportTCP6
+	case *net.UDPAddr:
+		if addr.IP.To4() != nil {
+			return ProxyTransportUDP4
+		}
+		return ProxyTransportUDP6
+	case *net.UnixAddr:
+		if addr.Net == "unixgram" {
+			return ProxyTransportUnixgram
+		}
+		return ProxyTransportUnix
+	}
+	return ProxyTransportUnspec
+}
+
+func (hdr *ProxyHeader) formatV1(transport ProxyTransport) ([]byte, error) {
+	var proto string
+	switch transport {
+	case ProxyTransportUnspec:
+		return []byte("PROXY UNKNOWN\r\n"), nil
+	case ProxyTransportTCP4:
+		proto = "TCP4"
+	case ProxyTransportTCP6:
+		proto = "TCP6"
+	default:
+		return nil, errors.Errorf("proxy protocol v1 does not support transport: %#x", transport)
+	}
+
+	src, ok1 := hdr.Source.(*net.TCPAddr)
+	dst, ok2 := hdr.Destination.(*net.TCPAddr)
+	if !ok1 || !ok2 {
+		return nil, errors.New("proxy protocol v1 requires tcp addresses")
+	}
+
+	srcIP, dstIP := src.IP.To4(), dst.IP.To4()
+	if transport == ProxyTransportTCP6 {
+		srcIP, dstIP = src.IP.To16(), dst.IP.To16()
+	}
+	if srcIP == nil || dstIP == nil {
+		return nil, errors.Errorf("invalid proxy protocol v1 address: %s %s", src, dst)
+	}
+	return []byte(strings.Join([]string{"PROXY", proto, srcIP.String(), dstIP.String(),
+		strconv.Itoa(src.Port), strconv.Itoa(dst.Port)}, " ") + "\r\n"), nil
 }
 
-func (c *bufConn) Read(b []byte) (n int, err error) {
-	if c.init {
-		return c.Conn.Read(b)
+func (hdr *ProxyHeader) formatV2(transport ProxyTransport) ([]byte, error) {
+	if hdr.Command != ProxyCommandLocal && hdr.Command != ProxyCommandProxy {
+		return nil, errors.Errorf("invalid proxy protocol v2 command: %#x", hdr.Command)
+	}
+
+	buf := append([]byte(nil), signatureV2...)
+	buf = append(buf, 0x20|byte(hdr.Command), byte(transport), 0, 0)
+
+	if transport&0x0F != 0 {
+		addrs, err := formatProxyAddrV2(transport, hdr.Source, hdr.Destination)
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, addrs...)
+	}
+
+	var err error
+	for _, tlv := range hdr.formatTLVs() {
+		if buf, err = appendProxyTLV(buf, tlv); err != nil {
+			return nil, err
+		}
+	}
+	if hdr.CRC32C {
+		buf = append(buf, ProxyTLVCRC32C, 0, 4, 0, 0, 0, 0)
+	}
+
+	if len(buf)-signatureLen-4 > maximumLenV2 {
+		return nil, errors.New("proxy protocol v2 header too long")
+	}
+	binary.BigEndian.PutUint16(buf[14:16], uint16(len(buf)-signatureLen-4))
+	if hdr.CRC32C {
+		binary.BigEndian.PutUint32(buf[len(buf)-4:], crc32.Checksum(buf, crc32.MakeTable(crc32.Castagnoli)))
 	}
+	return buf, nil
+}
+
+func formatProxyAddrV2(transport ProxyTransport, src, dst net.Addr) ([]byte, error) {
+	switch transport >> 4 {
+	case 0x1, 0x2: // AF_INET, AF_INET6
+		srcIP, srcPort := proxyIPPort(src)
+		dstIP, dstPort := proxyIPPort(dst)
+		if transport>>4 == 0x1 {
+			srcIP, dstIP = srcIP.To4(), dstIP.To4()
+		} else {
+			srcIP, dstIP = srcIP.To16(), dstIP.To16()
+		}
+		if srcIP == nil || dstIP == nil {
+			return nil, errors.Errorf("invalid proxy protocol v2 address: %s %s", src, dst)
+		}
+
+		b := append(append([]byte(nil), srcIP...), dstIP...)
+		b = append(b, byte(srcPort>>8), byte(srcPort), byte(dstPort>>8), byte(dstPort))
+		return b, nil
+
+	case 0x3: // AF_UNIX
+		srcAddr, ok1 := src.(*net.UnixAddr)
+		dstAddr, ok2 := dst.(*net.UnixAddr)
+		if !ok1 || !ok2 || len(srcAddr.Name) > 108 || len(dstAddr.Name) > 108 {
+			return nil, errors.Errorf("invalid proxy protocol v2 address: %s %s", src, dst)
+		}
 
-	if len(c.buf) == c.offset+1 {
-		return 0, c.err
+		b := make([]byte, 216)
+		copy(b, srcAddr.Name)
+		copy(b[108:], dstAddr.Name)
+		return b, nil
 	}
+	return nil, errors.Errorf("invalid proxy protocol v2 transport: %#x", transport)
+}
+
+func proxyIPPort(addr net.Addr) (net.IP, int) {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP, addr.Port
+	case *net.UDPAddr:
+		return addr.IP, addr.Port
+	}
+	return nil, 0
+}
+
+// formatTLVs collect the TLVs to encode, except the CRC32C
+func (hdr *ProxyHeader) formatTLVs() []ProxyTLV {
+	var tlvs []ProxyTLV
+	if len(hdr.ALPN) != 0 {
+		tlvs = append(tlvs, ProxyTLV{Type: ProxyTLVALPN, Value: hdr.ALPN})
+	}
+	if hdr.Authority != "" {
+		tlvs = append(tlvs, ProxyTLV{Type: ProxyTLVAuthority, Value: []byte(hdr.Authority)})
+	}
+	if len(hdr.UniqueID) != 0 {
+		tlvs = append(tlvs, ProxyTLV{Type: ProxyTLVUniqueID, Value: hdr.UniqueID})
+	}
+	if hdr.SSL != nil {
+		tlvs = append(tlvs, ProxyTLV{Type: ProxyTLVSSL, Value: hdr.SSL.format()})
+	}
+	if hdr.NetNS != "" {
+		tlvs = append(tlvs, ProxyTLV{Type: ProxyTLVNetNS, Value: []byte(hdr.NetNS)})
+	}
+
+	for _, tlv := range hdr.TLVs {
+		switch tlv.Type {
+		case ProxyTLVALPN, ProxyTLVAuthority, ProxyTLVCRC32C, ProxyTLVUniqueID, ProxyTLVSSL, ProxyTLVNetNS:
+		default:
+			tlvs = append(tlvs, tlv)
+		}
+	}
+	return tlvs
+}
+
+func (ssl *ProxySSL) format() []byte {
+	b := []byte{ssl.Client, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(b[1:], ssl.Verify)
+
+	for _, sub := range []ProxyTLV{
+		{Type: ProxyTLVSSLVersion, Value: []byte(ssl.Version)},
+		{Type: ProxyTLVSSLCN, Value: []byte(ssl.CN)},
+		{Type: ProxyTLVSSLCipher, Value: []byte(ssl.Cipher)},
+		{Type: ProxyTLVSSLSigAlg, Value: []byte(ssl.SigAlg)},
+		{Type: ProxyTLVSSLKeyAlg, Value: []byte(ssl.KeyAlg)},
+	} {
+		if len(sub.Value) != 0 {
+			b, _ = appendProxyTLV(b, sub)
+		}
+	}
+	for _, sub := range ssl.TLVs {
+		switch sub.Type {
+		case ProxyTLVSSLVersion, ProxyTLVSSLCN, ProxyTLVSSLCipher, ProxyTLVSSLSigAlg, ProxyTLVSSLKeyAlg:
+		default:
+			b, _ = appendProxyTLV(b, sub)
+		}
+	}
+	return b
+}
 
-	n = copy(b, c.buf[c.offset:])
-	c.offset += n
-	if c.offset == len(c.buf) && c.err == nil {
-		c.init = true
+func appendProxyTLV(b []byte, tlv ProxyTLV) ([]byte, error) {
+	if len(tlv.Value) > maximumLenV2 {
+		return nil, errors.Errorf("proxy protocol v2 tlv %#x too long", tlv.Type)
 	}
-	return n, nil
+	b = append(b, tlv.Type, byte(len(tlv.Value)>>8), byte(len(tlv.Value)))
+	return append(b, tlv.Value...), nil
 }
 
 func ReadSignal(c net.Conn, b, signal []byte) (n, idx int, err error) {
@@ -1,9 +1,13 @@
 package pgrpc_test
 
 import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
 	"io/ioutil"
 	"net"
 	"testing"
+	"time"
 
 	"github.com/wweir/pgrpc"
 )
@@ -93,3 +97,256 @@ func Test_ParseProxyProto3(t *testing.T) {
 		t.Errorf("parse data fail: %s", data)
 	}
 }
+
+func proxyTLV(typ byte, value []byte) []byte {
+	return append([]byte{typ, byte(len(value) >> 8), byte(len(value))}, value...)
+}
+
+func proxyHeaderV2(verCmd, fam byte, body []byte, crc bool) []byte {
+	if crc {
+		body = append(body, proxyTLV(pgrpc.ProxyTLVCRC32C, []byte{0, 0, 0, 0})...)
+	}
+	hdr := []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A, verCmd, fam,
+		byte(len(body) >> 8), byte(len(body))}
+	hdr = append(hdr, body...)
+	if crc {
+		binary.BigEndian.PutUint32(hdr[len(hdr)-4:], crc32.Checksum(hdr, crc32.MakeTable(crc32.Castagnoli)))
+	}
+	return hdr
+}
+
+func Test_ParseProxyHeader(t *testing.T) {
+	addrs := []byte{10, 0, 0, 1, 10, 0, 0, 2, 0x1F, 0x90, 0x01, 0xBB}
+	ssl := append([]byte{0x07, 0, 0, 0, 0}, proxyTLV(pgrpc.ProxyTLVSSLCN, []byte("node-1"))...)
+	tlvs := append(append(append(append(proxyTLV(pgrpc.ProxyTLVALPN, []byte("h2")),
+		proxyTLV(pgrpc.ProxyTLVAuthority, []byte("example.com"))...),
+		proxyTLV(pgrpc.ProxyTLVUniqueID, []byte{1, 2, 3})...),
+		proxyTLV(pgrpc.ProxyTLVSSL, ssl)...),
+		proxyTLV(pgrpc.ProxyTLVNetNS, []byte("blue"))...)
+	badCRC := proxyHeaderV2(0x21, 0x11, append([]byte(nil), addrs...), true)
+	badCRC[len(badCRC)-1] ^= 0xFF
+
+	for _, tc := range []struct {
+		name     string
+		in       []byte
+		err      bool
+		check    func(*pgrpc.ProxyHeader) bool
+		src, dst string
+	}{
+		{name: "none", in: []byte("GET / HTTP/1.1\r\n")},
+		{name: "v1 tcp6", in: []byte("PROXY TCP6 ::1 ::2 1000 2000\r\n"), src: "[::1]:1000", dst: "[::2]:2000",
+			check: func(h *pgrpc.ProxyHeader) bool { return h.Version == 1 && h.Transport == pgrpc.ProxyTransportTCP6 }},
+		{name: "v1 unknown", in: []byte("PROXY UNKNOWN\r\n"),
+			check: func(h *pgrpc.ProxyHeader) bool { return h.Source == nil }},
+		{name: "v1 bad address", in: []byte("PROXY TCP4 ::1 ::2 1000 2000\r\n"), err: true},
+		{name: "v2 tlvs", in: proxyHeaderV2(0x21, 0x11, append(append([]byte(nil), addrs...), tlvs...), true),
+			src: "10.0.0.1:8080", dst: "10.0.0.2:443",
+			check: func(h *pgrpc.ProxyHeader) bool {
+				return string(h.ALPN) == "h2" && h.Authority == "example.com" && h.CRC32C &&
+					len(h.UniqueID) == 3 && h.SSL != nil && h.SSL.Client == 0x07 && h.SSL.CN == "node-1" &&
+					h.NetNS == "blue" && len(h.TLVs) == 6
+			}},
+		{name: "v2 udp", in: proxyHeaderV2(0x21, 0x12, append([]byte(nil), addrs...), false), src: "10.0.0.1:8080", dst: "10.0.0.2:443",
+			check: func(h *pgrpc.ProxyHeader) bool { return h.Transport == pgrpc.ProxyTransportUDP4 }},
+		{name: "v2 local", in: proxyHeaderV2(0x20, 0x11, append([]byte(nil), addrs...), false),
+			check: func(h *pgrpc.ProxyHeader) bool { return h.Command == pgrpc.ProxyCommandLocal && h.Source == nil }},
+		// an unspecified family with a protocol carries no addresses
+		{name: "v2 unspec stream", in: proxyHeaderV2(0x21, 0x01, nil, false),
+			check: func(h *pgrpc.ProxyHeader) bool { return h.Command == pgrpc.ProxyCommandProxy && h.Source == nil }},
+		{name: "v2 unspec dgram", in: proxyHeaderV2(0x21, 0x02, nil, false),
+			check: func(h *pgrpc.ProxyHeader) bool { return h.Source == nil && h.Destination == nil }},
+		{name: "v2 bad crc", in: badCRC, err: true},
+		{name: "v2 bad version", in: proxyHeaderV2(0x11, 0x11, append([]byte(nil), addrs...), false), err: true},
+		{name: "v2 truncated tlv", in: proxyHeaderV2(0x21, 0x11, append(append([]byte(nil), addrs...), 0x01, 0, 9), false), err: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c1, c2 := net.Pipe()
+			go func() {
+				c1.Write(tc.in)
+				c1.Write([]byte("123"))
+				c1.Close()
+			}()
+
+			conn, hdr, err := pgrpc.ParseProxyHeader(c2)
+			if (err != nil) != tc.err {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err != nil {
+				return
+			}
+			if (hdr != nil) != (tc.check != nil) || (hdr != nil && !tc.check(hdr)) {
+				t.Fatalf("unexpected header: %+v", hdr)
+			}
+			if tc.src != "" && (conn.RemoteAddr().String() != tc.src || conn.LocalAddr().String() != tc.dst) {
+				t.Errorf("unexpected addrs: %s %s", conn.RemoteAddr(), conn.LocalAddr())
+			}
+
+			want := "123"
+			if hdr == nil {
+				want = string(tc.in) + want
+			}
+			if data, _ := ioutil.ReadAll(conn); string(data) != want {
+				t.Errorf("parse data fail: %q", data)
+			}
+		})
+	}
+}
+
+// Test_ParseProxyHeaderVersion pin the v2 ver_cmd byte 0x02 of
+// Test_ParseProxyProto2: only ParseProxyProto still ignores the version and
+// command, ParseProxyHeader and so ProxyListener and WithProxyProtocol reject it
+func Test_ParseProxyHeaderVersion(t *testing.T) {
+	addrs := []byte{192, 168, 1, 2, 192, 168, 1, 3, 10086 >> 8, 10086 & 0xFF, 10010 >> 8, 10010 & 0xFF}
+	pipe := func(verCmd byte) net.Conn {
+		c1, c2 := net.Pipe()
+		go func() {
+			c1.Write(proxyHeaderV2(verCmd, 0x11, append([]byte(nil), addrs...), false))
+			c1.Close()
+		}()
+		return c2
+	}
+	for _, verCmd := range []byte{0x02, 0x11, 0x23} {
+		conn := pipe(verCmd)
+		if _, hdr, err := pgrpc.ParseProxyHeader(conn); err == nil {
+			t.Errorf("ver_cmd %#x accepted: %+v", verCmd, hdr)
+		}
+		conn.Close()
+
+		conn = pipe(verCmd)
+		if _, addr, err := pgrpc.ParseProxyProto(conn); err != nil || addr != "192.168.1.2" {
+			t.Errorf("ver_cmd %#x: unexpected legacy parse: %s, %v", verCmd, addr, err)
+		}
+		conn.Close()
+	}
+}
+
+func Test_ProxyHeaderRoundTrip(t *testing.T) {
+	tcp4 := func(ip string, port int) net.Addr { return &net.TCPAddr{IP: net.ParseIP(ip).To4(), Port: port} }
+	tcp6 := func(ip string, port int) net.Addr { return &net.TCPAddr{IP: net.ParseIP(ip), Port: port} }
+	udp4 := func(ip string, port int) net.Addr { return &net.UDPAddr{IP: net.ParseIP(ip).To4(), Port: port} }
+	udp6 := func(ip string, port int) net.Addr { return &net.UDPAddr{IP: net.ParseIP(ip), Port: port} }
+
+	for _, tc := range []struct {
+		name string
+		hdr  *pgrpc.ProxyHeader
+		ip   string
+	}{
+		{name: "v1 tcp4", ip: "192.168.1.2", hdr: &pgrpc.ProxyHeader{Version: 1, Command: pgrpc.ProxyCommandProxy,
+			Transport: pgrpc.ProxyTransportTCP4, Source: tcp4("192.168.1.2", 10086), Destination: tcp4("192.168.1.3", 10010)}},
+		{name: "v1 tcp6", ip: "fe80::1", hdr: &pgrpc.ProxyHeader{Version: 1, Command: pgrpc.ProxyCommandProxy,
+			Transport: pgrpc.ProxyTransportTCP6, Source: tcp6("fe80::1", 1), Destination: tcp6("fe80::2", 65535)}},
+		{name: "v1 unknown", hdr: &pgrpc.ProxyHeader{Version: 1, Command: pgrpc.ProxyCommandProxy}},
+		{name: "v2 tcp4", ip: "10.0.0.1", hdr: &pgrpc.ProxyHeader{Version: 2, Command: pgrpc.ProxyCommandProxy,
+			Transport: pgrpc.ProxyTransportTCP4, Source: tcp4("10.0.0.1", 8080), Destination: tcp4("10.0.0.2", 443)}},
+		{name: "v2 udp4", ip: "10.0.0.1", hdr: &pgrpc.ProxyHeader{Version: 2, Command: pgrpc.ProxyCommandProxy,
+			Transport: pgrpc.ProxyTransportUDP4, Source: udp4("10.0.0.1", 53), Destination: udp4("10.0.0.2", 53)}},
+		{name: "v2 tcp6", ip: "2001:db8::1", hdr: &pgrpc.ProxyHeader{Version: 2, Command: pgrpc.ProxyCommandProxy,
+			Transport: pgrpc.ProxyTransportTCP6, Source: tcp6("2001:db8::1", 8080), Destination: tcp6("2001:db8::2", 443)}},
+		{name: "v2 udp6", ip: "2001:db8::1", hdr: &pgrpc.ProxyHeader{Version: 2, Command: pgrpc.ProxyCommandProxy,
+			Transport: pgrpc.ProxyTransportUDP6, Source: udp6("2001:db8::1", 53), Destination: udp6("2001:db8::2", 53)}},
+		{name: "v2 unix", ip: "/tmp/src.sock", hdr: &pgrpc.ProxyHeader{Version: 2, Command: pgrpc.ProxyCommandProxy,
+			Transport: pgrpc.ProxyTransportUnix, Source: &net.UnixAddr{Name: "/tmp/src.sock", Net: "unix"},
+			Destination: &net.UnixAddr{Name: "/tmp/dst.sock", Net: "unix"}}},
+		{name: "v2 unixgram", ip: "/tmp/src.sock", hdr: &pgrpc.ProxyHeader{Version: 2, Command: pgrpc.ProxyCommandProxy,
+			Transport: pgrpc.ProxyTransportUnixgram, Source: &net.UnixAddr{Name: "/tmp/src.sock", Net: "unixgram"},
+			Destination: &net.UnixAddr{Name: "/tmp/dst.sock", Net: "unixgram"}}},
+		{name: "v2 unspec", hdr: &pgrpc.ProxyHeader{Version: 2, Command: pgrpc.ProxyCommandProxy}},
+		{name: "v2 local", hdr: &pgrpc.ProxyHeader{Version: 2, Command: pgrpc.ProxyCommandLocal}},
+		{name: "v2 tlvs", ip: "10.0.0.1", hdr: &pgrpc.ProxyHeader{Version: 2, Command: pgrpc.ProxyCommandProxy,
+			Transport: pgrpc.ProxyTransportTCP4, Source: tcp4("10.0.0.1", 8080), Destination: tcp4("10.0.0.2", 443),
+			ALPN: []byte("h2"), Authority: "example.com", CRC32C: true, UniqueID: []byte("id-1"), NetNS: "blue",
+			SSL: &pgrpc.ProxySSL{Client: 0x01, Version: "TLSv1.3", CN: "node-1", Cipher: "TLS_AES_128_GCM_SHA256",
+				TLVs: []pgrpc.ProxyTLV{{Type: pgrpc.ProxyTLVSSLVersion, Value: []byte("TLSv1.3")},
+					{Type: pgrpc.ProxyTLVSSLCN, Value: []byte("node-1")},
+					{Type: pgrpc.ProxyTLVSSLCipher, Value: []byte("TLS_AES_128_GCM_SHA256")}}},
+			TLVs: []pgrpc.ProxyTLV{{Type: 0xE0, Value: []byte("custom")}}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := tc.hdr.Format()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c1, c2 := net.Pipe()
+			go func() {
+				c1.Write(b)
+				c1.Write([]byte("123"))
+				c1.Close()
+			}()
+			conn, hdr, err := pgrpc.ParseProxyHeader(c2)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := *tc.hdr
+			if want.Command == pgrpc.ProxyCommandLocal {
+				want.Source, want.Destination = nil, nil
+			}
+			if hdr.Version != want.Version || hdr.Command != want.Command || hdr.Transport != want.Transport ||
+				fmt.Sprint(hdr.Source) != fmt.Sprint(want.Source) ||
+				fmt.Sprint(hdr.Destination) != fmt.Sprint(want.Destination) ||
+				string(hdr.ALPN) != string(want.ALPN) || hdr.Authority != want.Authority ||
+				hdr.CRC32C != want.CRC32C || string(hdr.UniqueID) != string(want.UniqueID) ||
+				hdr.NetNS != want.NetNS || fmt.Sprint(hdr.SSL) != fmt.Sprint(want.SSL) {
+				t.Errorf("round trip fail:\n%+v\n%+v", hdr, &want)
+			}
+			if want.TLVs != nil && fmt.Sprint(hdr.TLVs[len(hdr.TLVs)-2]) != fmt.Sprint(want.TLVs[0]) {
+				t.Errorf("custom tlv lost: %+v", hdr.TLVs)
+			}
+			if data, _ := ioutil.ReadAll(conn); string(data) != "123" {
+				t.Errorf("parse data fail: %q", data)
+			}
+
+			c1, c2 = net.Pipe()
+			go func() {
+				c1.Write(b)
+				c1.Close()
+			}()
+			if _, ip, err := pgrpc.ParseProxyProto(c2); err != nil || ip != tc.ip {
+				t.Errorf("parse proxy proto fail: %q %v", ip, err)
+			}
+		})
+	}
+}
+
+func Test_ProxyListener(t *testing.T) {
+	tcpLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := pgrpc.NewProxyListener(tcpLn, &pgrpc.ProxyPolicy{Trusted: []string{"127.0.0.1"}, Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// a silent peer does not block Accept
+	slow, err := net.Dial("tcp", tcpLn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	if _, err := ln.Accept(); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		conn, err := net.Dial("tcp", tcpLn.Addr().String())
+		if err != nil {
+			return
+		}
+		conn.Write([]byte("PROXY TCP4 192.168.1.2 192.168.1.3 10086 10010\r\n123"))
+		conn.Close()
+	}()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr := conn.RemoteAddr().String(); addr != "192.168.1.2:10086" {
+		t.Errorf("unexpected remote addr: %s", addr)
+	}
+	if data, _ := ioutil.ReadAll(conn); string(data) != "123" {
+		t.Errorf("unexpected data: %q", data)
+	}
+}
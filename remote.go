@@ -0,0 +1,612 @@
+package pgrpc
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+)
+
+// remote is the conns dialed by a server Session, shared by the pools of all
+// the ids it registers
+type remote struct {
+	key   string // see remoteKey
+	token string // token of the Session
+	*Client
+
+	mu    sync.Mutex
+	ids   map[string]bool // registered ids, true while draining
+	conns []*idleConn
+	muxes []*muxSession
+	next  int // round robin of muxes
+	ctrl  net.Conn
+	ctrlA *admission                // admission of ctrl
+	taken map[*takenConn]*admission // conns taken by the client, not closed yet
+	since time.Time                 // last time a conn is put
+	dead  bool
+
+	direct     string    // direct address advertised by the server
+	directFail time.Time // last time direct dial failed
+
+	labels map[string]string
+	claims *tokenClaims // verified token, see WithTokenAuth
+}
+
+// admission is the registration a conn of the server is admitted for. The
+// ids a conn may serve are its own, since the conns of a Session may come
+// from different sources or present different tokens.
+type admission struct {
+	addr  net.Addr
+	hello *hello
+	ids   map[string]bool // guarded by remote.mu
+}
+
+// idleConn is an idle conn of a remote, since is the last time it is known
+// alive
+type idleConn struct {
+	net.Conn
+	*admission
+	since time.Time
+}
+
+// takenConn is a conn taken by the client, it is forgotten by the remote once
+// closed
+type takenConn struct {
+	net.Conn
+	remote *remote
+	once   sync.Once
+}
+
+func (c *takenConn) Close() error {
+	c.once.Do(func() {
+		c.remote.mu.Lock()
+		delete(c.remote.taken, c)
+		c.remote.mu.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+// muxSession is a multiplexed conn of the server
+type muxSession struct {
+	*yamux.Session
+	*admission
+	conn net.Conn
+}
+
+// remoteKey identify the remote of a conn by the Session token with the
+// authenticated identity of the server, so a conn can not join the remote of
+// another server by presenting its token
+func remoteKey(conn net.Conn, h *hello) string {
+	key := []string{h.Session, peerIdentity(conn)}
+	if h.noisePeer != nil {
+		key = append(key, base64.StdEncoding.EncodeToString(h.noisePeer.Public))
+	}
+	if h.claims != nil {
+		key = append(key, h.claims.subject)
+	}
+	return strings.Join(key, "|")
+}
+
+// attach find or create the remote of the Session sending hello on conn, and
+// share it with the pools of its ids
+func (c *Client) attach(conn net.Conn, h *hello) (*remote, *admission) {
+	key := remoteKey(conn, h)
+	a := &admission{addr: conn.RemoteAddr(), hello: h, ids: map[string]bool{}}
+	for _, id := range h.IDs {
+		a.ids[id] = true
+	}
+
+	c.remotesMu.Lock()
+	r, ok := c.remotes[key]
+	if !ok {
+		r = &remote{key: key, token: h.Session, Client: c,
+			ids: map[string]bool{}, taken: map[*takenConn]*admission{}}
+		c.remotes[key] = r
+	}
+	r.mu.Lock()
+	r.since = time.Now()
+	if r.direct != h.Direct {
+		r.direct = h.Direct
+		r.directFail = time.Time{}
+	}
+	r.labels = h.Labels
+	if h.claims != nil {
+		r.claims = h.claims
+	}
+	r.mu.Unlock()
+	c.remotesMu.Unlock()
+
+	for _, id := range h.IDs {
+		r.register(id)
+	}
+	return r, a
+}
+
+// register share the remote with the pool of id, a draining id is served
+// again once registered
+func (r *remote) register(id string) {
+	r.mu.Lock()
+	r.ids[id] = false
+	r.mu.Unlock()
+
+	val, _ := r.LoadOrStore(id, &pool{id: id, Client: r.Client})
+	val.(*pool).addRemote(r)
+}
+
+// gc forget the remote once it has no conn for a ping interval, and the
+// ClientConns closed without PutCC
+func (c *Client) gc() {
+	c.remotesMu.Lock()
+	var dead []*remote
+	for key, r := range c.remotes {
+		r.mu.Lock()
+		if r.ctrl == nil && len(r.conns) == 0 && len(r.muxes) == 0 && len(r.taken) == 0 &&
+			time.Since(r.since) >= c.pingInterval {
+			r.dead = true
+			delete(c.remotes, key)
+			dead = append(dead, r)
+		}
+		r.mu.Unlock()
+	}
+	c.remotesMu.Unlock()
+
+	// ClientConns closed without PutCC
+	c.dialed.Range(func(key, _ interface{}) bool {
+		if cc := key.(*grpc.ClientConn); cc.GetState() == connectivity.Shutdown {
+			c.dialed.Delete(cc)
+		}
+		return true
+	})
+
+	for _, r := range dead {
+		for id := range r.ids {
+			if val, ok := c.Load(id); ok {
+				val.(*pool).removeRemote(r)
+			}
+		}
+	}
+}
+
+// put cache an idle conn, and wake up the waiters of all the ids
+func (r *remote) put(conn *idleConn) {
+	conn.since = time.Now()
+
+	r.mu.Lock()
+	if r.dead || r.drained() {
+		r.mu.Unlock()
+		conn.Close()
+		return
+	}
+	r.conns = append(r.conns, conn)
+	r.since = conn.since
+	r.mu.Unlock()
+
+	r.notify()
+}
+
+// notify wake up the waiters of all the ids
+func (r *remote) notify() {
+	r.mu.Lock()
+	ids := make([]string, 0, len(r.ids))
+	for id := range r.ids {
+		ids = append(ids, id)
+	}
+	r.mu.Unlock()
+
+	for _, id := range ids {
+		if val, ok := r.Load(id); ok {
+			s := val.(*pool)
+			s.mu.Lock()
+			s.notify()
+			s.mu.Unlock()
+		}
+	}
+}
+
+// take open a stream or take an idle conn admitted for id, nil if none or
+// the id is draining
+func (r *remote) take(id string) (net.Conn, error) {
+	r.mu.Lock()
+	if draining, ok := r.ids[id]; !ok || draining {
+		r.mu.Unlock()
+		return nil, nil
+	}
+
+	var muxes []*muxSession
+	for _, mux := range r.muxes {
+		if mux.ids[id] {
+			muxes = append(muxes, mux)
+		}
+	}
+	if len(muxes) != 0 {
+		r.next++
+		mux := muxes[r.next%len(muxes)]
+		r.mu.Unlock()
+
+		stream, err := mux.Open()
+		if err != nil {
+			mux.Close()
+			return nil, errors.Wrap(err, "open stream")
+		}
+		if err := r.activate(stream, id); err != nil {
+			stream.Close()
+			return nil, err
+		}
+		return stream, nil
+	}
+
+	for i, conn := range r.conns {
+		if !conn.ids[id] {
+			continue
+		}
+		r.conns = append(r.conns[:i:i], r.conns[i+1:]...)
+		r.mu.Unlock()
+
+		if err := r.activate(conn.Conn, id); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return r.track(conn.Conn, conn.admission), nil
+	}
+
+	r.mu.Unlock()
+	return nil, nil
+}
+
+// activate tell the server the conn is taken for id by an open frame
+func (r *remote) activate(conn net.Conn, id string) error {
+	conn.SetWriteDeadline(time.Now().Add(r.handshakeTimeout))
+	if err := writeFrame(conn, frameOpen, []byte(id)); err != nil {
+		return err
+	}
+	return conn.SetWriteDeadline(time.Time{})
+}
+
+// pingLoop ping idle conns of all servers every ping interval
+func (c *Client) pingLoop() {
+	for range time.Tick(c.pingInterval) {
+		c.remotesMu.Lock()
+		for _, r := range c.remotes {
+			go r.pingIdle()
+		}
+		c.remotesMu.Unlock()
+
+		c.gc()
+		c.gcBuckets()
+		if c.closeRevoked {
+			c.revalidate()
+		}
+	}
+}
+
+// pingIdle ping the conns idle for a ping interval, conns missing a pong are
+// dropped
+func (r *remote) pingIdle() {
+	r.mu.Lock()
+	var due []*idleConn
+	conns := r.conns[:0]
+	for _, conn := range r.conns {
+		if time.Since(conn.since) >= r.pingInterval {
+			due = append(due, conn)
+		} else {
+			conns = append(conns, conn)
+		}
+	}
+	r.conns = conns
+	r.mu.Unlock()
+
+	for _, conn := range due {
+		go func(conn *idleConn) {
+			if err := ping(conn, r.pingInterval); err != nil {
+				r.Log("ping idle conn of %s fail: %s", r.token, err)
+				conn.Close()
+				return
+			}
+			r.put(conn)
+		}(conn)
+	}
+}
+
+func ping(conn net.Conn, timeout time.Duration) error {
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err := writeFrame(conn, framePing, nil); err != nil {
+		return err
+	}
+
+	typ, _, err := readFrame(conn)
+	if err != nil {
+		return err
+	}
+	if typ != framePong {
+		return errors.Errorf("unexpected frame type: %#x", typ)
+	}
+
+	conn.SetDeadline(time.Time{})
+	return nil
+}
+
+// serveCtrl hold a control conn of the server until it is closed, the ids
+// registered on it are checked against a, the admission of the conn
+func (r *remote) serveCtrl(conn net.Conn, a *admission) {
+	r.mu.Lock()
+	r.ctrl, r.ctrlA = conn, a
+	r.mu.Unlock()
+
+	defer func() {
+		r.mu.Lock()
+		if r.ctrl == conn {
+			r.ctrl, r.ctrlA = nil, nil
+		}
+		r.since = time.Now()
+		r.mu.Unlock()
+		conn.Close()
+	}()
+
+	go func() {
+		ticker := time.NewTicker(r.pingInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			conn.SetWriteDeadline(time.Now().Add(r.handshakeTimeout))
+			if err := writeFrame(conn, framePing, nil); err != nil {
+				conn.Close()
+				return
+			}
+		}
+	}()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(2 * r.pingInterval))
+		typ, payload, err := readFrame(conn)
+		if err != nil {
+			return
+		}
+
+		switch typ {
+		case framePong:
+		case frameDrain:
+			r.drain(string(payload))
+		case frameRegister:
+			if idLen := len(payload); idLen == 0 || idLen > MAX_ID_LEN {
+				r.Log("invalid id registered by %s: %q", r.token, payload)
+				continue
+			}
+			id := string(payload)
+			if reason := r.allow(a, id); reason != "" {
+				r.reject(a.addr, id, reason)
+				continue
+			}
+			r.register(id)
+			r.grant(id)
+		default:
+			r.Log("unknown control frame from %s: %#x", r.token, typ)
+		}
+	}
+}
+
+// allow return the reason the conn of a may not serve id, by the source
+// rules, its token and its noise key, empty if allowed
+func (r *remote) allow(a *admission, id string) string {
+	switch {
+	case !r.allowID(id, a.addr):
+		return RejectIDSource
+	case r.tokenVerifier != nil && (a.hello.claims == nil || !a.hello.claims.allow(id)):
+		return RejectTokenID
+	case r.noise != nil && (a.hello.noisePeer == nil || !a.hello.noisePeer.allow(id)):
+		return RejectNoiseID
+	}
+	return ""
+}
+
+// grant let the conns of the remote allowed to serve id serve it, once it is
+// registered on the control conn
+func (r *remote) grant(id string) {
+	r.mu.Lock()
+	admissions := make([]*admission, 0, len(r.conns)+len(r.muxes))
+	for _, conn := range r.conns {
+		admissions = append(admissions, conn.admission)
+	}
+	for _, mux := range r.muxes {
+		admissions = append(admissions, mux.admission)
+	}
+	r.mu.Unlock()
+
+	for _, a := range admissions {
+		if r.allow(a, id) == "" {
+			r.mu.Lock()
+			a.ids[id] = true
+			r.mu.Unlock()
+		}
+	}
+	r.notify()
+}
+
+// idle return the number of idle conns admitted for id
+func (r *remote) idle(id string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := 0
+	for _, conn := range r.conns {
+		if conn.ids[id] {
+			n++
+		}
+	}
+	return n
+}
+
+// track remember the conn taken by the client until it is closed
+func (r *remote) track(conn net.Conn, a *admission) net.Conn {
+	taken := &takenConn{Conn: conn, remote: r}
+	r.mu.Lock()
+	r.taken[taken] = a
+	r.mu.Unlock()
+	return taken
+}
+
+// revalidate close the conns whose credentials are revoked, idle or taken
+func (r *remote) revalidate() {
+	r.mu.Lock()
+	conns := make(map[net.Conn]*admission, len(r.conns)+len(r.taken)+len(r.muxes)+1)
+	for _, conn := range r.conns {
+		conns[conn.Conn] = conn.admission
+	}
+	for conn, a := range r.taken {
+		conns[conn.Conn] = a
+	}
+	for _, mux := range r.muxes {
+		conns[mux.conn] = mux.admission
+	}
+	if r.ctrl != nil {
+		conns[r.ctrl] = r.ctrlA
+	}
+	r.mu.Unlock()
+
+	revoked := map[net.Conn]bool{}
+	for conn, a := range conns {
+		if !r.validConn(conn) {
+			revoked[conn] = true
+			continue
+		}
+		if r.tokenVerifier != nil {
+			if _, err := r.tokenVerifier.verify(a.hello.Token); err != nil {
+				revoked[conn] = true
+			}
+		}
+	}
+	if len(revoked) == 0 {
+		return
+	}
+
+	r.mu.Lock()
+	idle := r.conns[:0]
+	for _, conn := range r.conns {
+		if !revoked[conn.Conn] {
+			idle = append(idle, conn)
+		}
+	}
+	r.conns = idle
+	for conn := range r.taken {
+		if revoked[conn.Conn] {
+			delete(r.taken, conn)
+		}
+	}
+	r.mu.Unlock()
+
+	for conn := range revoked {
+		r.reject(conn.RemoteAddr(), "", RejectRevoked)
+		conn.Close()
+	}
+}
+
+// drain avoid the draining id of the server for new calls, an empty id drains
+// all. Cached ClientConns of the id are closed, and idle conns as well once
+// all the ids are draining, in-flight streams are kept.
+func (r *remote) drain(id string) {
+	r.mu.Lock()
+	var ids []string
+	for rid := range r.ids {
+		if id == "" || rid == id {
+			r.ids[rid] = true
+			ids = append(ids, rid)
+		}
+	}
+
+	var conns []*idleConn
+	if r.drained() {
+		conns, r.conns = r.conns, nil
+	}
+	r.mu.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+	for _, id := range ids {
+		if val, ok := r.Load(id); ok {
+			val.(*pool).closeCCs()
+		}
+	}
+}
+
+// draining report whether id of the server is draining
+func (r *remote) draining(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.ids[id]
+}
+
+// drained report whether all the ids are draining, r.mu should be held
+func (r *remote) drained() bool {
+	for _, draining := range r.ids {
+		if !draining {
+			return false
+		}
+	}
+	return len(r.ids) != 0
+}
+
+// demand ask the server to dial n more idle conns
+func (r *remote) demand(n int) {
+	r.mu.Lock()
+	ctrl := r.ctrl
+	r.mu.Unlock()
+	if ctrl == nil {
+		return
+	}
+
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, uint16(n))
+	ctrl.SetWriteDeadline(time.Now().Add(r.handshakeTimeout))
+	if err := writeFrame(ctrl, frameDemand, payload); err != nil {
+		r.Log("demand conns from %s fail: %s", r.token, err)
+		ctrl.Close()
+		return
+	}
+	ctrl.SetWriteDeadline(time.Time{})
+}
+
+// serveMux hold a multiplexed conn of the server until it is closed
+func (r *remote) serveMux(conn net.Conn, a *admission) {
+	ys, err := yamux.Client(conn, muxConfig(r.Log))
+	if err != nil {
+		r.Log("init mux conn from %s fail: %s", r.token, err)
+		conn.Close()
+		return
+	}
+	mux := &muxSession{Session: ys, admission: a, conn: conn}
+
+	r.mu.Lock()
+	r.muxes = append(r.muxes, mux)
+	r.mu.Unlock()
+	r.notify()
+
+	// the streams opened by the server are control conns
+	go func() {
+		for {
+			stream, err := mux.Accept()
+			if err != nil {
+				return
+			}
+			go r.serveCtrl(stream, a)
+		}
+	}()
+
+	<-mux.CloseChan()
+
+	r.mu.Lock()
+	for i := range r.muxes {
+		if r.muxes[i] == mux {
+			r.muxes = append(r.muxes[:i], r.muxes[i+1:]...)
+			break
+		}
+	}
+	r.since = time.Now()
+	r.mu.Unlock()
+}
@@ -1,7 +1,8 @@
 package pgrpc
 
 import (
-	"bytes"
+	"bufio"
+	"context"
 	"net"
 	"sync"
 	"time"
@@ -9,15 +10,37 @@ import (
 	"github.com/pkg/errors"
 )
 
-type listener struct {
-	addr net.Addr
-	serverOpts
+// Listener is a net.Listener of reverse conns taken by the client for an id,
+// its conns are dialed by a Session
+type Listener struct {
+	id   string
+	sess *Session
 
-	connCh chan *activeConn
-	stopCh chan struct{}
+	connCh   chan *activeConn
+	stopCh   chan struct{}
+	stopOnce sync.Once
+
+	// guarded by sess.mu
+	activated uint64
+	direct    uint64
+	active    int // conns taken by the client and not closed yet
+	draining  bool
+}
+
+// ListenerStats is the idle pool stats of a Listener, the pool is shared by
+// all the Listeners of a Session
+type ListenerStats struct {
+	Idle      int    // idle conns waiting for the client to take
+	Dialing   int    // conns being dialed
+	Target    int    // idle conns the pool is growing or shrinking to
+	Active    int    // conns taken by the client and not closed yet
+	Activated uint64 // conns taken by the client in total
+	Direct    uint64 // conns dialed directly by the client in total
+	Dialed    uint64 // conns dialed to the client in total
+	Draining  bool
 }
 
-func (ln *listener) Accept() (net.Conn, error) {
+func (ln *Listener) Accept() (net.Conn, error) {
 	for {
 		select {
 		case conn := <-ln.connCh:
@@ -27,131 +50,209 @@ func (ln *listener) Accept() (net.Conn, error) {
 		}
 	}
 }
-func (ln *listener) Close() error {
-	close(ln.stopCh)
+
+// Close stop accepting conns of the id, the Session is closed with its last
+// Listener
+func (ln *Listener) Close() error {
+	ln.stopOnce.Do(func() {
+		close(ln.stopCh)
+		ln.sess.remove(ln)
+	})
 	return nil
 }
-func (ln *listener) Addr() net.Addr {
-	return ln.addr
+func (ln *Listener) Addr() net.Addr {
+	return ln.sess.addr
 }
 
-//Listen start a pgrpc server with session id, it will tcp connect to the address
-func Listen(address, id string, opts ...ServerOpt) (net.Listener, error) {
-	if idLen := len(id); len(id) > MAX_ID_LEN {
-		return nil, errors.Errorf("id(%s) is too long", id)
-	} else if idLen == 0 {
-		return nil, errors.Errorf("id is empty")
-	}
+// ID return the id the Listener is registered with
+func (ln *Listener) ID() string {
+	return ln.id
+}
 
-	ln := &listener{
-		connCh: make(chan *activeConn, MIN_IDLE-1),
-		stopCh: make(chan struct{}),
-	}
+// Session return the Session dialing conns for the Listener
+func (ln *Listener) Session() *Session {
+	return ln.sess
+}
 
-	for _, opt := range opts {
-		opt.applyServer(&ln.serverOpts)
-	}
+// Stats return the idle pool stats
+func (ln *Listener) Stats() ListenerStats {
+	s := ln.sess
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	var err error
-	if ln.addr, err = net.ResolveTCPAddr("tcp", address); err != nil {
-		return nil, err
+	return ListenerStats{
+		Idle:      len(s.idle),
+		Dialing:   s.dialing,
+		Target:    s.target,
+		Active:    ln.active,
+		Activated: ln.activated,
+		Direct:    ln.direct,
+		Dialed:    s.dialed,
+		Draining:  ln.draining,
 	}
+}
 
-	go func() {
-	DIAL_LOOP:
-		for {
-			conn, err := net.Dial("tcp", address)
-			if err != nil {
-				ln.Log("tcp dial %s fail: %s", address, err)
-				continue
-			}
+// Drain tell the client to avoid this Listener for new calls, then wait for
+// the taken conns to be closed by the client, eg: the in-flight RPCs finish.
+// The Session stops dialing new conns once all its Listeners are draining.
+// The Listener is closed once drained or ctx is done.
+func (ln *Listener) Drain(ctx context.Context) error {
+	defer ln.Close()
 
-			for _, fn := range ln.onAccept {
-				if conn, err = fn(conn); err != nil {
-					ln.Log("tcp on accept hook fail: %s", err)
-					time.Sleep(5 * time.Second)
-					continue DIAL_LOOP
-				}
-			}
+	s := ln.sess
+	s.mu.Lock()
+	ln.draining = true
+	ctrl := s.ctrl
+	s.mu.Unlock()
 
-			aConn, err := newActiveConn(ln, conn, id)
-			if err != nil {
-				ln.Log("init tcp conn fail: %s", err)
-				time.Sleep(time.Second)
-				continue
-			}
+	if ctrl != nil {
+		s.writeCtrl(ctrl, frameDrain, []byte(ln.id))
+	}
+
+	// idle conns are closed by the client once it knows the whole Session is
+	// draining, the left ones are closed after a handshake timeout
+	grace := time.After(s.handshakeTimeout)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		s.mu.Lock()
+		drained := ln.active == 0 && (!s.draining() || len(s.idle) == 0)
+		s.mu.Unlock()
+		if drained {
+			return nil
+		}
 
-			ln.connCh <- aConn
-			select {
-			case <-aConn.init:
-			case <-ln.stopCh:
-				aConn.Close()
-				return
+		select {
+		case <-ticker.C:
+		case <-grace:
+			var idle []*activeConn
+			s.mu.Lock()
+			if s.draining() {
+				for aConn := range s.idle {
+					idle = append(idle, s.evict(aConn))
+				}
 			}
+			s.mu.Unlock()
+			closeConns(idle)
+		case <-ctx.Done():
+			return ctx.Err()
 		}
-	}()
+	}
+}
+
+// Listen start a pgrpc server with session id, it will tcp connect to the address.
+// The returned net.Listener is a *Listener, see Listener.Drain
+func Listen(address, id string, opts ...ServerOpt) (net.Listener, error) {
+	s, err := NewSession(address, opts...)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := s.Listen(id)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
 	return ln, nil
 }
 
-// activeConn is a net.Conn that can detect conn first activaty
+// activeConn is a net.Conn handed out from Accept once the client takes it,
+// before that it answers the keepalive pings from the client
 type activeConn struct {
-	init chan struct{}
-	once sync.Once
+	sess      *Session
+	ln        *Listener // the Listener it is taken for
+	r         *bufio.Reader
+	once      sync.Once
+	closeOnce sync.Once
+	direct    bool // dialed by the client, see WithDirect
+	evicted   bool // removed from the idle pool to be closed, guarded by sess.mu
+	identity  string
+	info      *SessionInfo // set once activated
 
-	*listener
 	net.Conn
 }
 
-func newActiveConn(ln *listener, conn net.Conn, id string) (*activeConn, error) {
-	aConn := activeConn{listener: ln, Conn: conn, init: make(chan struct{})}
+func newActiveConn(s *Session, conn net.Conn) *activeConn {
+	return &activeConn{sess: s, Conn: conn, r: bufio.NewReader(conn)}
+}
 
-	// write id
-	buf := make([]byte, MAX_ID_LEN)
-	copy(buf, []byte(id))
+// wait answer pings until the client takes the conn by an open frame, which
+// carries the id it is taken for. It fails while no ping is received in 3 ping
+// intervals, so half-open conns are recycled.
+func (a *activeConn) wait() (id string, err error) {
+	for {
+		a.Conn.SetReadDeadline(time.Now().Add(3 * a.sess.pingInterval))
+		typ, payload, err := readFrame(a.r)
+		if err != nil {
+			return "", err
+		}
+		if typ == frameOpen {
+			id = string(payload)
+			break
+		}
+		if typ != framePing {
+			return "", errors.Errorf("unexpected frame type: %#x", typ)
+		}
 
-	aConn.SetDeadline(time.Now().Add(5 * time.Second))
-	var err error
-	for n, nn := 0, 0; nn < MAX_ID_LEN; nn += n {
-		if n, err = aConn.Write(buf[nn:]); err != nil {
-			aConn.Close()
-			return nil, errors.Errorf("write id fail: %s", err)
+		a.Conn.SetWriteDeadline(time.Now().Add(a.sess.handshakeTimeout))
+		if err := writeFrame(a.Conn, framePong, payload); err != nil {
+			return "", err
 		}
 	}
 
-	aConn.SetDeadline(time.Time{})
-	return &aConn, nil
+	a.Conn.SetDeadline(time.Time{})
+	return id, nil
 }
 
-var tlsHandshark = []byte{0x16, 0x03, 0x01} // h2 tls handshake TLS 1.0
-var h2cHandshark = []byte("PRISM")          // h2c [P]RISM
+// activate hand the conn to the Listener of id, nil if the id is not
+// registered or the conn is closed
+func (a *activeConn) activate(id string) *Listener {
+	a.once.Do(func() {
+		if a.ln = a.sess.onActivate(a, id); a.ln == nil {
+			return
+		}
 
-func (a *activeConn) Read(b []byte) (n int, err error) {
-	select {
-	case <-a.init:
-		return a.Conn.Read(b)
-	default:
-	}
+		path := PathReverse
+		if a.direct {
+			path = PathDirect
+		}
+		a.info = &SessionInfo{
+			ID:         a.ln.id,
+			Session:    a.sess.token,
+			ClientAddr: a.Conn.RemoteAddr(),
+			Path:       path,
+			Labels:     a.sess.labels,
+			Identity:   a.identity,
+		}
+	})
+	return a.ln
+}
 
-	// redial after 30s
-	a.Conn.SetDeadline(time.Now().Add(30 * time.Second))
-	if n, err = a.Conn.Read(b); err != nil {
-		return n, errors.Errorf("tcp on accept hook fail: %s", err)
-	}
-	a.Conn.SetDeadline(time.Time{})
+// SessionInfo return the registration the conn is served for
+func (a *activeConn) SessionInfo() *SessionInfo {
+	return a.info
+}
 
-	// detect handshake
-	if bytes.HasPrefix(b, tlsHandshark) || bytes.HasPrefix(b, h2cHandshark) {
-		a.once.Do(func() {
-			close(a.init)
-		})
+// RemoteAddr return the client address, which carries the SessionInfo to grpc
+// handlers, see SessionFromContext
+func (a *activeConn) RemoteAddr() net.Addr {
+	if a.info == nil {
+		return a.Conn.RemoteAddr()
 	}
-
-	return n, err
+	return &sessionAddr{Addr: a.Conn.RemoteAddr(), info: a.info}
 }
 
 func (a *activeConn) Close() error {
-	a.once.Do(func() {
-		close(a.init)
+	a.closeOnce.Do(func() {
+		a.once.Do(func() {}) // never activate a closed conn
+		if a.ln != nil {
+			a.sess.mu.Lock()
+			a.ln.active--
+			a.sess.mu.Unlock()
+		}
 	})
 	return a.Conn.Close()
 }
+
+func (a *activeConn) Read(b []byte) (n int, err error) {
+	return a.r.Read(b)
+}
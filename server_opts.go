@@ -1,17 +1,49 @@
 package pgrpc
 
 import (
+	"context"
+	"crypto/tls"
 	"net"
+	"time"
 )
 
 type serverOpts struct {
 	logger
 
-	log      func(string, ...interface{})
 	onAccept []func(net.Conn) (net.Conn, error)
+	mux      bool
+	dial     func(ctx context.Context, network, address string) (net.Conn, error)
+
+	directAddr, directAdvertise string
+	labels                      map[string]string
+	proxyHeader                 *ProxyHeader
+	authToken                   string // see WithToken
+
+	tlsConfig        *tls.Config
+	noise            *noiseConfig
+	creds            *Credentials
+	handshakeTimeout time.Duration
+	pingInterval     time.Duration
+	keepAlive        time.Duration
+	minIdle, maxIdle int
+
+	err error // invalid option, returned by NewSession
 }
 
-// ServerOpt is the client options
+// ServerOpt is the server options
 type ServerOpt interface {
 	applyServer(*serverOpts)
 }
+
+type dialer struct {
+	dial func(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// WithDialer set the dial func used to connect to the client, eg: dial
+// through a proxy or bind a local address
+func WithDialer(dial func(ctx context.Context, network, address string) (net.Conn, error)) ServerOpt {
+	return &dialer{dial: dial}
+}
+func (o *dialer) applyServer(so *serverOpts) {
+	so.dial = o.dial
+}
@@ -0,0 +1,135 @@
+package pgrpc_test
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/wweir/pgrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// serveHealth serve the grpc health service on ln
+func serveHealth(ln *pgrpc.Listener) *grpc.Server {
+	s := grpc.NewServer()
+	healthpb.RegisterHealthServer(s, health.NewServer())
+	go s.Serve(ln)
+	return s
+}
+
+// check call the health service on cc
+func check(t *testing.T, cc *grpc.ClientConn) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := healthpb.NewHealthClient(cc).Check(ctx, &healthpb.HealthCheckRequest{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_ListenerDrain(t *testing.T) {
+	c, addr := newClient(t, pgrpc.WithGrpcDialOpt(grpc.WithInsecure()))
+	ln, err := pgrpc.Listen(addr, "drain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serveHealth(ln.(*pgrpc.Listener)).Stop()
+	waitServer(t, c, "drain")
+
+	// a ClientConn checked out while the server drains
+	cc, err := c.Dial("drain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(t, cc)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	drained := make(chan error, 1)
+	start := time.Now()
+	go func() { drained <- ln.(*pgrpc.Listener).Drain(ctx) }()
+
+	waitFor(t, "the client to avoid drain", func() bool {
+		cc, err := c.Dial("drain")
+		if err != nil {
+			return true
+		}
+		c.PutCC(cc, nil)
+		return false
+	})
+	select {
+	case err := <-drained:
+		t.Fatalf("drained with a ClientConn checked out: %v", err)
+	default:
+	}
+
+	c.PutCC(cc, nil)
+	if err := <-drained; err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("drain took %s", elapsed)
+	}
+}
+
+func Test_OpenFrame(t *testing.T) {
+	// a client speaking the frames by hand
+	fake, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fake.Close()
+
+	ln, err := pgrpc.Listen(fake.Addr().String(), "open", pgrpc.WithIdlePool(2, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go serveEcho(ln)
+
+	// accept the idle data conns, the control conn is left alone
+	var conns []net.Conn
+	for len(conns) < 2 {
+		conn, err := fake.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		typ, payload, err := readFrame(conn)
+		if err != nil || typ != 0x82 {
+			t.Fatalf("unexpected hello: %#x %s %v", typ, payload, err)
+		}
+		writeFrame(t, conn, 0x86, []byte("{}"))
+		var h struct{ Kind string }
+		if json.Unmarshal(payload, &h); h.Kind == "data" {
+			conns = append(conns, conn)
+		}
+	}
+
+	// idle conns answer pings, and are taken by an open frame only, the
+	// first data is not sniffed
+	conn := conns[0]
+	writeFrame(t, conn, 0x84, []byte("ping"))
+	if typ, payload, err := readFrame(conn); err != nil || typ != 0x85 || string(payload) != "ping" {
+		t.Fatalf("unexpected pong: %#x %s %v", typ, payload, err)
+	}
+	writeFrame(t, conn, 0x80, []byte("open"))
+	echo(t, conn, "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")
+	if stats := ln.(*pgrpc.Listener).Stats(); stats.Activated != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	// a conn taken for an unknown id is closed
+	conn = conns[1]
+	writeFrame(t, conn, 0x80, []byte("unknown"))
+	if _, err := ioutil.ReadAll(conn); err != nil {
+		t.Fatalf("conn not closed: %v", err)
+	}
+}
@@ -0,0 +1,693 @@
+package pgrpc
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"github.com/pkg/errors"
+)
+
+// shrinkInterval is how often an idle pool shrinks by one conn while it is
+// not consumed
+const shrinkInterval = 10 * time.Second
+
+// Session keeps an adaptive pool of idle conns dialed to the client, shared by
+// all the ids registered by Listen. A conn is handed to the Listener of the id
+// the client takes it for. The Session is closed with its last Listener.
+type Session struct {
+	addr    net.Addr
+	address string
+	token   string // random token identifying this Session to the client
+	serverOpts
+
+	stopCh    chan struct{}
+	stopOnce  sync.Once
+	startOnce sync.Once
+	kickCh    chan struct{}
+
+	mu        sync.Mutex
+	ids       []string // registered ids, in order
+	listeners map[string]*Listener
+	idle      map[*activeConn]struct{} // dialed, not activated yet
+	dialing   int
+	target    int // idle conns to keep, adapts between minIdle and maxIdle
+	activated uint64
+	dialed    uint64
+	ctrl      net.Conn // current control conn
+
+	direct net.Listener // listener of direct conns, see WithDirect
+}
+
+// NewSession init a session to the client at address, it starts dialing once
+// an id is registered by Listen
+func NewSession(address string, opts ...ServerOpt) (*Session, error) {
+	s := &Session{
+		address: address,
+		token:   randomToken(),
+		serverOpts: serverOpts{
+			dial:             (&net.Dialer{}).DialContext,
+			handshakeTimeout: defaultHandshakeTimeout,
+			pingInterval:     defaultPingInterval,
+			keepAlive:        defaultKeepAlive,
+			minIdle:          MIN_IDLE,
+			maxIdle:          MAX_IDLE,
+		},
+		stopCh:    make(chan struct{}),
+		kickCh:    make(chan struct{}, 1),
+		listeners: map[string]*Listener{},
+		idle:      map[*activeConn]struct{}{},
+	}
+
+	for _, opt := range opts {
+		opt.applyServer(&s.serverOpts)
+	}
+	if s.err != nil {
+		return nil, s.err
+	}
+	s.target = s.minIdle
+
+	var err error
+	if s.addr, err = net.ResolveTCPAddr("tcp", address); err != nil {
+		return nil, err
+	}
+	if s.directAddr != "" {
+		if s.direct, err = net.Listen("tcp", s.directAddr); err != nil {
+			return nil, errors.Wrap(err, "direct listen")
+		}
+	}
+	return s, nil
+}
+
+// Listen register id on the session, conns taken by the client for the id are
+// accepted from the returned Listener
+func (s *Session) Listen(id string) (*Listener, error) {
+	if idLen := len(id); len(id) > MAX_ID_LEN {
+		return nil, errors.Errorf("id(%s) is too long", id)
+	} else if idLen == 0 {
+		return nil, errors.Errorf("id is empty")
+	}
+
+	ln := &Listener{
+		id:     id,
+		sess:   s,
+		connCh: make(chan *activeConn),
+		stopCh: make(chan struct{}),
+	}
+
+	s.mu.Lock()
+	if s.stopped() {
+		s.mu.Unlock()
+		return nil, errors.New("session has been closed")
+	}
+	if _, ok := s.listeners[id]; ok {
+		s.mu.Unlock()
+		return nil, errors.Errorf("id(%s) is already registered", id)
+	}
+	s.ids = append(s.ids, id)
+	s.listeners[id] = ln
+	ctrl := s.ctrl
+	s.mu.Unlock()
+
+	// conns dialed before are shared with the new id as well
+	if ctrl != nil {
+		s.writeCtrl(ctrl, frameRegister, []byte(id))
+	}
+
+	s.startOnce.Do(func() {
+		if s.mux {
+			go s.keepMux()
+		} else {
+			go s.keepIdle()
+			go s.keepCtrl()
+		}
+		if s.direct != nil {
+			go s.serveDirect(s.direct)
+		}
+	})
+	s.kick()
+	return ln, nil
+}
+
+// Close close all the Listeners and conns of the session
+func (s *Session) Close() error {
+	s.mu.Lock()
+	var lns []*Listener
+	for _, ln := range s.listeners {
+		lns = append(lns, ln)
+	}
+	s.mu.Unlock()
+
+	for _, ln := range lns {
+		ln.Close()
+	}
+	s.stop()
+	return nil
+}
+
+func (s *Session) stop() {
+	s.stopOnce.Do(func() {
+		close(s.stopCh)
+		// the direct listener is opened by NewSession, served or not
+		if s.direct != nil {
+			s.direct.Close()
+		}
+	})
+}
+
+func (s *Session) stopped() bool {
+	select {
+	case <-s.stopCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// remove unregister a closed Listener, the client avoids it for new calls
+func (s *Session) remove(ln *Listener) {
+	s.mu.Lock()
+	if s.listeners[ln.id] != ln {
+		s.mu.Unlock()
+		return
+	}
+	delete(s.listeners, ln.id)
+	for i := range s.ids {
+		if s.ids[i] == ln.id {
+			s.ids = append(s.ids[:i], s.ids[i+1:]...)
+			break
+		}
+	}
+	last := len(s.listeners) == 0
+	ctrl := s.ctrl
+	s.mu.Unlock()
+
+	if last {
+		s.stop()
+	} else if ctrl != nil {
+		s.writeCtrl(ctrl, frameDrain, []byte(ln.id))
+	}
+}
+
+// IDs return the ids registered on the session
+func (s *Session) IDs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.ids...)
+}
+
+// draining report whether all the Listeners are draining, s.mu should be held
+func (s *Session) draining() bool {
+	for _, ln := range s.listeners {
+		if !ln.draining {
+			return false
+		}
+	}
+	return true
+}
+
+// writeCtrl send a frame on the control conn, a conn failing to write is
+// closed and redialed
+func (s *Session) writeCtrl(ctrl net.Conn, typ byte, payload []byte) {
+	ctrl.SetWriteDeadline(time.Now().Add(s.handshakeTimeout))
+	if err := writeFrame(ctrl, typ, payload); err != nil {
+		s.Log("send control frame to %s fail: %s", s.address, err)
+		ctrl.Close()
+	}
+}
+
+// keepIdle keep target idle conns dialed to the client. The target grows
+// toward maxIdle every time the pool is exhausted, and shrinks toward minIdle
+// while no conn is taken in a shrinkInterval, surplus idle conns dialed on
+// demand are closed then as well.
+func (s *Session) keepIdle() {
+	ticker := time.NewTicker(shrinkInterval)
+	defer ticker.Stop()
+
+	var lastActivated uint64
+	for {
+		s.mu.Lock()
+		for !s.draining() && len(s.idle)+s.dialing < s.target {
+			s.dialing++
+			go s.dialIdle()
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-s.kickCh:
+		case <-ticker.C:
+			var surplus []*activeConn
+			s.mu.Lock()
+			if s.activated == lastActivated {
+				if s.target > s.minIdle {
+					s.target--
+				}
+				for aConn := range s.idle {
+					if len(s.idle) <= s.target {
+						break
+					}
+					surplus = append(surplus, s.evict(aConn))
+				}
+			}
+			lastActivated = s.activated
+			s.mu.Unlock()
+			closeConns(surplus)
+
+		case <-s.stopCh:
+			var idle []*activeConn
+			s.mu.Lock()
+			for aConn := range s.idle {
+				idle = append(idle, s.evict(aConn))
+			}
+			s.mu.Unlock()
+			closeConns(idle)
+			return
+		}
+	}
+}
+
+// evict remove an idle conn from the pool to be closed, it is never activated
+// then. s.mu should be held, and the conn closed after s.mu is released, as
+// closing waits for an activation in progress, which takes s.mu.
+func (s *Session) evict(aConn *activeConn) *activeConn {
+	delete(s.idle, aConn)
+	aConn.evicted = true
+	return aConn
+}
+
+func closeConns(conns []*activeConn) {
+	for _, aConn := range conns {
+		aConn.Close()
+	}
+}
+
+func (s *Session) kick() {
+	select {
+	case s.kickCh <- struct{}{}:
+	default:
+	}
+}
+
+// dialIdle dial an idle conn to the client, and hold it until it is taken
+func (s *Session) dialIdle() {
+	defer s.kick()
+
+	aConn, err := s.dialActiveConn()
+	if err != nil {
+		if !s.stopped() {
+			s.Log("dial %s fail: %s", s.address, err)
+		}
+		// still counted as dialing while backing off, so the pool does not
+		// redial meanwhile
+		select {
+		case <-time.After(retryDelay(err)):
+		case <-s.stopCh:
+		}
+		s.mu.Lock()
+		s.dialing--
+		s.mu.Unlock()
+		return
+	}
+
+	s.mu.Lock()
+	s.dialing--
+	s.dialed++
+	s.idle[aConn] = struct{}{}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.idle, aConn)
+		s.mu.Unlock()
+	}()
+
+	s.serveActiveConn(aConn)
+}
+
+// serveActiveConn wait for the client to take the conn, then hand it to the
+// Listener of the id it is taken for
+func (s *Session) serveActiveConn(aConn *activeConn) {
+	id, err := aConn.wait()
+	if err != nil {
+		if !s.stopped() {
+			s.Log("wait for the client to take conn fail: %s", err)
+		}
+		aConn.Close()
+		return
+	}
+
+	ln := aConn.activate(id)
+	if ln == nil {
+		s.Log("conn taken for unknown id: %s", id)
+		aConn.Close()
+		return
+	}
+
+	select {
+	case ln.connCh <- aConn:
+	case <-ln.stopCh:
+		aConn.Close()
+	}
+}
+
+// onActivate record a conn taken by the client for id, grow the pool if
+// exhausted
+func (s *Session) onActivate(aConn *activeConn, id string) *Listener {
+	s.mu.Lock()
+	defer s.kick()
+	defer s.mu.Unlock()
+
+	ln := s.listeners[id]
+	if ln == nil || aConn.evicted {
+		return nil
+	}
+
+	delete(s.idle, aConn)
+	s.activated++
+	ln.activated++
+	ln.active++
+	if aConn.direct {
+		ln.direct++
+	}
+	if !s.mux && !aConn.direct && len(s.idle)+s.dialing == 0 && s.target < s.maxIdle {
+		s.target = s.target*2 + 1
+		if s.target > s.maxIdle {
+			s.target = s.maxIdle
+		}
+	}
+	return ln
+}
+
+// dialActiveConn dial an idle data conn to the client
+func (s *Session) dialActiveConn() (*activeConn, error) {
+	conn, err := s.dialConn()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.handshake(conn, kindData, s.IDs()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	aConn := newActiveConn(s, conn)
+	aConn.identity = peerIdentity(conn)
+	return aConn, nil
+}
+
+// handshake send hello to the client, and read its ack
+func (s *Session) handshake(conn net.Conn, kind string, ids []string) error {
+	if len(ids) == 0 {
+		return errors.New("no id registered")
+	}
+
+	conn.SetDeadline(time.Now().Add(s.handshakeTimeout))
+	h := &hello{ID: ids[0], IDs: ids, Kind: kind, Session: s.token, Direct: s.advertise(conn),
+		Labels: s.labels, Token: s.presentedToken()}
+	if err := writeHello(conn, h); err != nil {
+		return errors.Wrap(err, "write hello")
+	}
+
+	ack, err := readHelloAck(conn)
+	if err != nil {
+		return errors.Wrap(err, "read hello ack")
+	}
+	if ack.Reject != "" {
+		return &rejectError{reason: ack.Reject, backoff: time.Duration(ack.Backoff) * time.Millisecond}
+	}
+	conn.SetDeadline(time.Time{})
+	return nil
+}
+
+// presentedToken return the signed token presented to the client, see WithToken
+func (s *Session) presentedToken() string {
+	if s.creds != nil && s.creds.files.Token != "" {
+		return s.creds.currentToken()
+	}
+	return s.authToken
+}
+
+// dialConn dial the client, then upgrade the conn
+func (s *Session) dialConn() (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.handshakeTimeout)
+	defer cancel()
+
+	conn, err := s.dial(ctx, "tcp", s.address)
+	if err != nil {
+		return nil, err
+	}
+	setKeepAlive(conn, s.keepAlive)
+
+	if s.proxyHeader != nil {
+		conn.SetWriteDeadline(time.Now().Add(s.handshakeTimeout))
+		if err := writeProxyHeader(conn, s.proxyHeader); err != nil {
+			conn.Close()
+			return nil, errors.Wrap(err, "write proxy header")
+		}
+		conn.SetWriteDeadline(time.Time{})
+	}
+	return s.upgrade(conn)
+}
+
+// upgrade run accept hooks, the noise and tls handshakes, conn is closed on
+// failure
+func (s *Session) upgrade(conn net.Conn) (net.Conn, error) {
+	var err error
+	for _, fn := range s.onAccept {
+		if conn, err = fn(conn); err != nil {
+			if conn != nil {
+				conn.Close()
+			}
+			return nil, errors.Wrap(err, "tcp on accept hook")
+		}
+	}
+
+	if s.noise != nil {
+		conn.SetDeadline(time.Now().Add(s.handshakeTimeout))
+		nc, err := noiseHandshake(conn, s.noise, true)
+		if err != nil {
+			conn.Close()
+			return nil, errors.Wrap(err, "noise handshake")
+		}
+		conn.SetDeadline(time.Time{})
+		conn = nc
+	}
+
+	config := s.tlsConfig
+	if s.creds != nil {
+		config = s.creds.tlsConfig(config, false)
+	}
+	if config != nil {
+		if config.ServerName == "" {
+			config = config.Clone()
+			config.ServerName, _, _ = net.SplitHostPort(s.address)
+		}
+
+		tlsConn := tls.Client(conn, config)
+		tlsConn.SetDeadline(time.Now().Add(s.handshakeTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			tlsConn.Close()
+			return nil, errors.Wrap(err, "tls handshake")
+		}
+		tlsConn.SetDeadline(time.Time{})
+		conn = tlsConn
+	}
+	return conn, nil
+}
+
+// keepCtrl keep a control conn to the client, through which the client asks
+// for more idle conns on demand. With WithMux, the control conn is a stream of
+// the mux conn instead.
+func (s *Session) keepCtrl() {
+	for {
+		err := s.serveCtrl()
+		if err != nil && !s.stopped() {
+			s.Log("control conn to %s fail: %s", s.address, err)
+		}
+
+		select {
+		case <-time.After(retryDelay(err)):
+		case <-s.stopCh:
+			return
+		}
+	}
+}
+
+func (s *Session) serveCtrl() error {
+	conn, err := s.dialConn()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ids := s.IDs()
+	if err := s.handshake(conn, kindCtrl, ids); err != nil {
+		return err
+	}
+	return s.runCtrl(conn, ids)
+}
+
+// runCtrl serve the control frames on conn, ids are the ones registered by
+// the handshake
+func (s *Session) runCtrl(conn net.Conn, ids []string) error {
+	// catch up with the ids registered or draining during the handshake
+	s.mu.Lock()
+	s.ctrl = conn
+	var registers, drains []string
+	for _, id := range s.ids {
+		if !contains(ids, id) {
+			registers = append(registers, id)
+		}
+		if s.listeners[id].draining {
+			drains = append(drains, id)
+		}
+	}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		if s.ctrl == conn {
+			s.ctrl = nil
+		}
+		s.mu.Unlock()
+	}()
+
+	for _, id := range registers {
+		s.writeCtrl(conn, frameRegister, []byte(id))
+	}
+	for _, id := range drains {
+		s.writeCtrl(conn, frameDrain, []byte(id))
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-s.stopCh:
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(3 * s.pingInterval))
+		typ, payload, err := readFrame(conn)
+		if err != nil {
+			return err
+		}
+
+		switch typ {
+		case frameDemand:
+			if len(payload) == 2 {
+				s.demand(int(binary.BigEndian.Uint16(payload)))
+			}
+		case framePing:
+			conn.SetWriteDeadline(time.Now().Add(s.handshakeTimeout))
+			if err := writeFrame(conn, framePong, payload); err != nil {
+				return err
+			}
+		default:
+			s.Log("unknown control frame: %#x", typ)
+		}
+	}
+}
+
+// keepMux keep a multiplexed conn to the client, every stream opened by the
+// client is an activeConn
+func (s *Session) keepMux() {
+	for {
+		err := s.serveMux()
+		if err != nil && !s.stopped() {
+			s.Log("mux conn to %s fail: %s", s.address, err)
+		}
+
+		select {
+		case <-time.After(retryDelay(err)):
+		case <-s.stopCh:
+			return
+		}
+	}
+}
+
+func (s *Session) serveMux() error {
+	conn, err := s.dialConn()
+	if err != nil {
+		return err
+	}
+
+	ids := s.IDs()
+	if err := s.handshake(conn, kindMux, ids); err != nil {
+		conn.Close()
+		return err
+	}
+	identity := peerIdentity(conn)
+
+	session, err := yamux.Server(conn, muxConfig(s.Log))
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer session.Close()
+
+	// the control conn is the stream opened by the server, the mux conn is
+	// redialed once it fails
+	ctrl, err := session.Open()
+	if err != nil {
+		return errors.Wrap(err, "open control stream")
+	}
+	go func() {
+		defer session.Close()
+		if err := s.runCtrl(ctrl, ids); err != nil && !s.stopped() {
+			s.Log("control stream to %s fail: %s", s.address, err)
+		}
+	}()
+
+	go func() {
+		select {
+		case <-s.stopCh:
+			session.Close()
+		case <-session.CloseChan():
+		}
+	}()
+
+	for {
+		stream, err := session.Accept()
+		if err != nil {
+			return err
+		}
+
+		go s.serveStream(stream, identity)
+	}
+}
+
+// serveStream activate a logical stream like an idle conn
+func (s *Session) serveStream(stream net.Conn, identity string) {
+	aConn := newActiveConn(s, stream)
+	aConn.identity = identity
+	s.mu.Lock()
+	s.dialed++
+	s.mu.Unlock()
+
+	s.serveActiveConn(aConn)
+}
+
+// demand dial n more idle conns at once, at most maxIdle. It is ignored with
+// WithMux, whose streams are opened by the client on demand.
+func (s *Session) demand(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.mux || s.draining() {
+		return
+	}
+	if n > s.maxIdle {
+		n = s.maxIdle
+	}
+	for i := 0; i < n; i++ {
+		s.dialing++
+		go s.dialIdle()
+	}
+}
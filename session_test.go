@@ -0,0 +1,203 @@
+package pgrpc_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/wweir/pgrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// writeFrame send a frame like a peer
+func writeFrame(t *testing.T, conn net.Conn, typ byte, payload []byte) {
+	t.Helper()
+	frame := append([]byte{typ, byte(len(payload) >> 8), byte(len(payload))}, payload...)
+	if _, err := conn.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeHello send a hello frame like a server
+func writeHello(t *testing.T, conn net.Conn, h map[string]interface{}) {
+	t.Helper()
+	payload, _ := json.Marshal(h)
+	writeFrame(t, conn, 0x82, payload)
+}
+
+// readFrame read a frame like a server
+func readFrame(conn net.Conn) (byte, []byte, error) {
+	hdr := make([]byte, 3)
+	if _, err := io.ReadFull(conn, hdr); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, int(hdr[1])<<8|int(hdr[2]))
+	_, err := io.ReadFull(conn, payload)
+	return hdr[0], payload, err
+}
+
+func Test_SessionAdmission(t *testing.T) {
+	c, addr := newClient(t, pgrpc.WithIDSourceAllow("secure", "127.0.0.1"))
+	ln, err := pgrpc.Listen(addr, "secure", pgrpc.WithIdlePool(0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go serveEcho(ln)
+	waitServer(t, c, "secure")
+	token := c.Servers("secure")[0].Session
+
+	// a conn from another source joins the Session by its token, but is only
+	// admitted for the id it may register
+	dialer := &net.Dialer{LocalAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2)}}
+	spoof, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		t.Skip("no 127.0.0.2:", err)
+	}
+	defer spoof.Close()
+	writeHello(t, spoof, map[string]interface{}{"id": "public", "kind": "data", "session": token})
+	spoof.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if typ, payload, err := readFrame(spoof); err != nil || typ != 0x86 || string(payload) != "{}" {
+		t.Fatalf("unexpected hello ack: %#x %s %v", typ, payload, err)
+	}
+	waitServer(t, c, "public")
+
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		conn, err := c.DialConn(ctx, "secure")
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		echo(t, conn, "from the real server")
+		conn.Close()
+	}
+
+	spoof.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if typ, payload, err := readFrame(spoof); err == nil {
+		t.Fatalf("spoofed conn taken: %#x %s", typ, payload)
+	}
+}
+
+func Test_AdaptivePool(t *testing.T) {
+	c, addr := newClient(t)
+	ln, err := pgrpc.Listen(addr, "pool", pgrpc.WithIdlePool(1, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go serveEcho(ln)
+	waitServer(t, c, "pool")
+
+	stats := ln.(*pgrpc.Listener).Stats
+	waitFor(t, "the min idle conn", func() bool { return stats().Idle == 1 })
+	if target := stats().Target; target != 1 {
+		t.Fatalf("unexpected target: %d", target)
+	}
+
+	// taking the only idle conn exhausts the pool, which grows up to max
+	for i := 0; i < 6; i++ {
+		conn, err := c.DialConn(context.Background(), "pool")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		echo(t, conn, "hello pool")
+	}
+	waitFor(t, "the pool to grow", func() bool {
+		s := stats()
+		return s.Target == 3 && s.Idle == 3
+	})
+	if s := stats(); s.Active != 6 || s.Activated != 6 {
+		t.Fatalf("unexpected stats: %+v", s)
+	}
+}
+
+func Test_CtrlDemand(t *testing.T) {
+	c, addr := newClient(t)
+	ln, err := pgrpc.Listen(addr, "demand", pgrpc.WithIdlePool(0, 4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go serveEcho(ln)
+	waitServer(t, c, "demand")
+
+	// only the control conn is dialed until the client asks for conns
+	stats := ln.(*pgrpc.Listener).Stats
+	time.Sleep(100 * time.Millisecond)
+	if s := stats(); s.Idle != 0 || s.Dialed != 0 {
+		t.Fatalf("unexpected stats: %+v", s)
+	}
+
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		conn, err := c.DialConn(ctx, "demand")
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		echo(t, conn, "hello on demand")
+		conn.Close()
+	}
+	if s := stats(); s.Dialed == 0 || s.Activated != 3 {
+		t.Fatalf("unexpected stats: %+v", s)
+	}
+}
+
+func Test_SessionListen(t *testing.T) {
+	c, addr := newClient(t, pgrpc.WithGrpcDialOpt(grpc.WithInsecure()))
+	sess, err := pgrpc.NewSession(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+
+	// a grpc server per id, sharing the conns of one Session
+	for _, id := range []string{"svc-a", "svc-b"} {
+		ln, err := sess.Listen(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hs := health.NewServer()
+		hs.SetServingStatus(id, healthpb.HealthCheckResponse_SERVING)
+		s := grpc.NewServer()
+		healthpb.RegisterHealthServer(s, hs)
+		go s.Serve(ln)
+		defer s.Stop()
+		waitServer(t, c, id)
+	}
+	if servers := c.Servers(""); len(servers) != 1 || len(servers[0].IDs) != 2 {
+		t.Fatalf("unexpected servers: %+v", servers)
+	}
+
+	for i := 0; i < 3; i++ {
+		for _, id := range []string{"svc-a", "svc-b"} {
+			cc, err := c.Dial(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client := healthpb.NewHealthClient(cc)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			_, err = client.Check(ctx, &healthpb.HealthCheckRequest{Service: id})
+			if err != nil {
+				t.Fatalf("check %s: %v", id, err)
+			}
+			// each id reaches its own grpc server
+			other := map[string]string{"svc-a": "svc-b", "svc-b": "svc-a"}[id]
+			_, err = client.Check(ctx, &healthpb.HealthCheckRequest{Service: other})
+			if status.Code(err) != codes.NotFound {
+				t.Fatalf("check %s on %s: %v", other, id, err)
+			}
+			cancel()
+			c.PutCC(cc, nil)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package pgrpc
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// socks5 reply codes, RFC 1928
+const (
+	socks5Succeeded          byte = 0x00
+	socks5GeneralFailure     byte = 0x01
+	socks5NotAllowed         byte = 0x02
+	socks5HostUnreachable    byte = 0x04
+	socks5CmdNotSupported    byte = 0x07
+	socks5AddrTypeNotSupport byte = 0x08
+)
+
+// ServeSOCKS5 serve a socks5 proxy on ln with the global client
+func ServeSOCKS5(ln net.Listener, route func(user, target string) (id string, err error)) error {
+	return defaultClient.ServeSOCKS5(ln, route)
+}
+
+// ServeSOCKS5 serve a socks5 proxy on ln, every CONNECT request egresses from
+// the server selected by route, which should serve the conns by ServeForward.
+// If route is nil, the socks5 username is used as the server id.
+func (c *Client) ServeSOCKS5(ln net.Listener, route func(user, target string) (id string, err error)) error {
+	if route == nil {
+		route = func(user, _ string) (string, error) {
+			if user == "" {
+				return "", errors.New("socks5 username is required as server id")
+			}
+			return user, nil
+		}
+	}
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+
+		go func(conn net.Conn) {
+			if err := c.serveSOCKS5(conn, route); err != nil {
+				c.Log("socks5 %s fail: %s", conn.RemoteAddr(), err)
+				conn.Close()
+			}
+		}(conn)
+	}
+}
+
+func (c *Client) serveSOCKS5(conn net.Conn, route func(user, target string) (string, error)) error {
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	user, err := socks5Auth(conn)
+	if err != nil {
+		return err
+	}
+
+	target, err := socks5Request(conn)
+	if err != nil {
+		return err
+	}
+
+	id, err := route(user, target)
+	if err != nil {
+		socks5Reply(conn, socks5NotAllowed)
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	ctx = ContextWithCaller(ctx, callerOfConn(conn))
+	remote, err := c.DialForward(ctx, id, target)
+	if err != nil {
+		rep := socks5GeneralFailure
+		if errors.Cause(err) == ErrUnauthorized {
+			rep = socks5NotAllowed
+		}
+		if fe, ok := err.(*ForwardError); ok {
+			rep = socks5HostUnreachable
+			if fe.Denied() {
+				rep = socks5NotAllowed
+			}
+		}
+		socks5Reply(conn, rep)
+		return errors.Wrapf(err, "connect %s via %s", target, id)
+	}
+
+	if err := socks5Reply(conn, socks5Succeeded); err != nil {
+		remote.Close()
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+
+	pipe(conn, remote)
+	return nil
+}
+
+// socks5Auth negotiate the auth method, username/password is preferred so the
+// username can be used for routing
+func socks5Auth(conn net.Conn) (user string, err error) {
+	buf := make([]byte, 255)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return "", err
+	}
+	if buf[0] != 0x05 {
+		return "", errors.Errorf("invalid socks version: %d", buf[0])
+	}
+
+	methods := make([]byte, int(buf[1]))
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+
+	var method byte = 0xFF // no acceptable methods
+	for _, m := range methods {
+		if m == 0x02 { // username/password
+			method = m
+			break
+		}
+		if m == 0x00 { // no authentication
+			method = m
+		}
+	}
+	if _, err := conn.Write([]byte{0x05, method}); err != nil {
+		return "", err
+	}
+
+	switch method {
+	case 0x00:
+		return "", nil
+	case 0x02:
+		// RFC 1929: ver(1) ulen(1) uname plen(1) passwd
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return "", err
+		}
+		uname := make([]byte, buf[1])
+		if _, err := io.ReadFull(conn, uname); err != nil {
+			return "", err
+		}
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return "", err
+		}
+		if _, err := io.ReadFull(conn, buf[:buf[0]]); err != nil {
+			return "", err
+		}
+
+		_, err := conn.Write([]byte{0x01, 0x00})
+		return string(uname), err
+	default:
+		return "", errors.New("no acceptable socks5 auth method")
+	}
+}
+
+// socks5Request read a CONNECT request, and return the target host:port
+func socks5Request(conn net.Conn) (string, error) {
+	buf := make([]byte, 255)
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+		return "", err
+	}
+	if buf[1] != 0x01 { // CONNECT
+		socks5Reply(conn, socks5CmdNotSupported)
+		return "", errors.Errorf("unsupported socks5 command: %d", buf[1])
+	}
+
+	var host string
+	switch buf[3] {
+	case 0x01: // IPv4
+		if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+			return "", err
+		}
+		host = net.IP(buf[:4]).String()
+	case 0x03: // domain name
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return "", err
+		}
+		l := buf[0]
+		if _, err := io.ReadFull(conn, buf[:l]); err != nil {
+			return "", err
+		}
+		host = string(buf[:l])
+	case 0x04: // IPv6
+		if _, err := io.ReadFull(conn, buf[:16]); err != nil {
+			return "", err
+		}
+		host = net.IP(buf[:16]).String()
+	default:
+		socks5Reply(conn, socks5AddrTypeNotSupport)
+		return "", errors.Errorf("unsupported socks5 address type: %d", buf[3])
+	}
+
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return "", err
+	}
+	port := binary.BigEndian.Uint16(buf[:2])
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
+
+func socks5Reply(conn net.Conn, rep byte) error {
+	// the bound address is meaningless for a reverse conn, always 0.0.0.0:0
+	_, err := conn.Write([]byte{0x05, rep, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,123 @@
+package pgrpc_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/wweir/pgrpc"
+)
+
+// socks5Connect negotiate a CONNECT to target as user, and return the reply
+// code
+func socks5Connect(t *testing.T, conn net.Conn, user string, target *net.TCPAddr) byte {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	buf := make([]byte, 10)
+	conn.Write([]byte{0x05, 0x01, 0x02})
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil || !bytes.Equal(buf[:2], []byte{0x05, 0x02}) {
+		t.Fatalf("unexpected method reply: %x, %v", buf[:2], err)
+	}
+	conn.Write(append(append([]byte{0x01, byte(len(user))}, user...), 0x00))
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil || !bytes.Equal(buf[:2], []byte{0x01, 0x00}) {
+		t.Fatalf("unexpected auth reply: %x, %v", buf[:2], err)
+	}
+
+	req := append([]byte{0x05, 0x01, 0x00, 0x01}, target.IP.To4()...)
+	req = append(req, 0, 0)
+	binary.BigEndian.PutUint16(req[len(req)-2:], uint16(target.Port))
+	conn.Write(req)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("read reply fail: %v", err)
+	}
+	return buf[1]
+}
+
+func Test_ServeSOCKS5(t *testing.T) {
+	c, addr := newClient(t)
+	ln, err := pgrpc.Listen(addr, "edge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go serveEcho(target)
+	go pgrpc.ServeForward(ln, target.Addr().String())
+
+	socksLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socksLn.Close()
+	go c.ServeSOCKS5(socksLn, nil)
+	waitServer(t, c, "edge")
+
+	t.Run("connect", func(t *testing.T) {
+		conn, err := net.Dial("tcp", socksLn.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		if rep := socks5Connect(t, conn, "edge", target.Addr().(*net.TCPAddr)); rep != 0x00 {
+			t.Fatalf("unexpected reply: %#x", rep)
+		}
+		echo(t, conn, "hello through edge")
+	})
+
+	t.Run("not allowed", func(t *testing.T) {
+		conn, err := net.Dial("tcp", socksLn.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		other := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+		if rep := socks5Connect(t, conn, "edge", other); rep != 0x02 {
+			t.Fatalf("unexpected reply: %#x", rep)
+		}
+	})
+
+	t.Run("malformed", func(t *testing.T) {
+		for _, greeting := range [][]byte{
+			{0x05, 0xFE},
+			{0x05, 0xFF},
+			append([]byte{0x05, 0xFF}, bytes.Repeat([]byte{0x01}, 0xFF)...),
+			{0x04, 0x01},
+		} {
+			conn, err := net.Dial("tcp", socksLn.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.Write(greeting)
+			conn.(*net.TCPConn).CloseWrite()
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			reply, _ := ioutil.ReadAll(conn)
+			conn.Close()
+			if len(greeting) > 2 && !bytes.Equal(reply, []byte{0x05, 0xFF}) {
+				t.Errorf("unexpected reply to %d methods: %x", greeting[1], reply)
+			}
+		}
+
+		// still serving
+		conn, err := net.Dial("tcp", socksLn.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if rep := socks5Connect(t, conn, "edge", target.Addr().(*net.TCPAddr)); rep != 0x00 {
+			t.Fatalf("unexpected reply: %#x", rep)
+		}
+	})
+}
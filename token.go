@@ -0,0 +1,436 @@
+package pgrpc
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	_ "crypto/sha256" // hashes of the token algs
+	_ "crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// reason of a RejectEvent by TokenAuth
+const (
+	RejectToken   = "token"    // token is missing, invalid, expired or revoked
+	RejectTokenID = "token_id" // id is not claimed by the token
+)
+
+// revocationCheck is how often the revocation file is checked for changes
+const revocationCheck = time.Second
+
+type token struct {
+	token string
+}
+
+// WithToken present a signed token (JWT) on registration, verified by the
+// clients with WithTokenAuth
+func WithToken(tok string) ServerOpt {
+	return &token{token: tok}
+}
+func (o *token) applyServer(so *serverOpts) {
+	so.authToken = o.token
+}
+
+// TokenAuth verify the signed tokens (JWT) presented by servers offline. A
+// token is signed by EdDSA, ES256/384/512, RS256/384/512 or PS256/384/512,
+// and should carry exp. The ids registered by the server should match the id
+// claim, a string or a list of them, as path.Match patterns. Other string,
+// number or bool claims are attached to the server as labels, overriding the
+// ones sent by the server, see Client.Servers.
+type TokenAuth struct {
+	Keys     []crypto.PublicKey // ed25519.PublicKey, *ecdsa.PublicKey or *rsa.PublicKey, see ParsePublicKeys and Credentials
+	Audience string             // required in aud if not empty
+	IDClaim  string             // claim of the ids, default "sub"
+	Leeway   time.Duration      // clock skew allowed for exp and nbf
+
+	// Revocations is a file of revoked token ids (jti) or subjects (sub),
+	// one per line, # starts a comment. It is reloaded on change.
+	Revocations string
+}
+
+type tokenAuth struct {
+	auth TokenAuth
+}
+
+// WithTokenAuth require servers to register with a signed token, see
+// WithToken
+func WithTokenAuth(auth TokenAuth) ClientOpt {
+	return &tokenAuth{auth: auth}
+}
+func (o *tokenAuth) applyClient(co *clientOpts) {
+	v, err := newTokenVerifier(o.auth, co.Log)
+	if err != nil {
+		co.err = err
+		return
+	}
+	co.tokenVerifier = v
+}
+
+// ParsePublicKeys parse the PEM encoded PKIX public keys, or certificates,
+// eg: of a token issuer
+func ParsePublicKeys(data []byte) ([]crypto.PublicKey, error) {
+	var keys []crypto.PublicKey
+	for {
+		var block *pem.Block
+		if block, data = pem.Decode(data); block == nil {
+			break
+		}
+
+		switch block.Type {
+		case "PUBLIC KEY":
+			key, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return nil, errors.Wrap(err, "parse public key")
+			}
+			keys = append(keys, key)
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, errors.Wrap(err, "parse certificate")
+			}
+			keys = append(keys, cert.PublicKey)
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("no public key found")
+	}
+	return keys, nil
+}
+
+// tokenClaims is the result of a verified token
+type tokenClaims struct {
+	subject string
+	ids     []string // id patterns
+	labels  map[string]string
+}
+
+// allow report whether id matches the id claim
+func (tc *tokenClaims) allow(id string) bool {
+	for _, pattern := range tc.ids {
+		if ok, _ := path.Match(pattern, id); ok {
+			return true
+		}
+	}
+	return false
+}
+
+type tokenVerifier struct {
+	TokenAuth
+	creds *Credentials // provide the keys if TokenKeys is set
+	log   func(format string, a ...interface{})
+
+	mu      sync.Mutex
+	checked time.Time // last time the revocation file is checked
+	modTime time.Time
+	revoked map[string]bool
+}
+
+func newTokenVerifier(auth TokenAuth, log func(format string, a ...interface{})) (*tokenVerifier, error) {
+	for _, key := range auth.Keys {
+		switch key.(type) {
+		case ed25519.PublicKey, *ecdsa.PublicKey, *rsa.PublicKey:
+		default:
+			return nil, errors.Errorf("unsupported token key: %T", key)
+		}
+	}
+	if auth.IDClaim == "" {
+		auth.IDClaim = "sub"
+	}
+
+	v := &tokenVerifier{TokenAuth: auth, log: log}
+	if auth.Revocations != "" {
+		if err := v.reload(); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+// keys return the public keys verifying tokens
+func (v *tokenVerifier) keys() []crypto.PublicKey {
+	if v.creds != nil && v.creds.files.TokenKeys != "" {
+		return v.creds.currentTokenKeys()
+	}
+	return v.Keys
+}
+
+// reload read the revocation file if it is modified
+func (v *tokenVerifier) reload() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.checked = time.Now()
+
+	info, err := os.Stat(v.Revocations)
+	if err != nil {
+		return errors.Wrap(err, "stat revocation file")
+	}
+	if info.ModTime().Equal(v.modTime) && v.revoked != nil {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(v.Revocations)
+	if err != nil {
+		return errors.Wrap(err, "read revocation file")
+	}
+
+	revoked := map[string]bool{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			revoked[line] = true
+		}
+	}
+	v.revoked, v.modTime = revoked, info.ModTime()
+	return nil
+}
+
+// isRevoked report whether the token id or subject is revoked, the
+// revocation file is reloaded if modified
+func (v *tokenVerifier) isRevoked(jti, sub string) bool {
+	if v.Revocations == "" {
+		return false
+	}
+
+	v.mu.Lock()
+	due := time.Since(v.checked) >= revocationCheck
+	v.mu.Unlock()
+	if due {
+		if err := v.reload(); err != nil && v.log != nil {
+			v.log("reload token revocations fail, keep the last ones: %s", err)
+		}
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return (jti != "" && v.revoked[jti]) || (sub != "" && v.revoked[sub])
+}
+
+// verify check the signature and claims of a compact JWT
+func (v *tokenVerifier) verify(tok string) (*tokenClaims, error) {
+	parts := strings.Split(tok, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, errors.Wrap(err, "invalid token header")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid token signature")
+	}
+	if err := v.verifySignature(header.Alg, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+
+	claims := map[string]interface{}{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, errors.Wrap(err, "invalid token claims")
+	}
+	if err := v.verifyClaims(claims); err != nil {
+		return nil, err
+	}
+
+	tc := &tokenClaims{labels: map[string]string{}}
+	tc.subject, _ = claims["sub"].(string)
+	jti, _ := claims["jti"].(string)
+	if v.isRevoked(jti, tc.subject) {
+		return nil, errors.New("token is revoked")
+	}
+
+	if tc.ids = claimStrings(claims[v.IDClaim]); len(tc.ids) == 0 {
+		return nil, errors.Errorf("no id claim %q", v.IDClaim)
+	}
+	for name, val := range claims {
+		switch name {
+		case "exp", "nbf", "iat", "aud", "jti", v.IDClaim:
+			continue
+		}
+		switch val := val.(type) {
+		case string, json.Number, bool:
+			tc.labels[name] = fmt.Sprint(val)
+		}
+	}
+	return tc, nil
+}
+
+// ecdsaBits is the curve size of the ECDSA algs
+var ecdsaBits = map[string]int{"ES256": 256, "ES384": 384, "ES512": 521}
+
+func (v *tokenVerifier) verifySignature(alg, signed string, sig []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "EdDSA":
+	case "ES256", "RS256", "PS256":
+		hash = crypto.SHA256
+	case "ES384", "RS384", "PS384":
+		hash = crypto.SHA384
+	case "ES512", "RS512", "PS512":
+		hash = crypto.SHA512
+	default:
+		return errors.Errorf("unsupported token alg: %q", alg)
+	}
+
+	var digest []byte
+	if hash != 0 {
+		h := hash.New()
+		h.Write([]byte(signed))
+		digest = h.Sum(nil)
+	}
+
+	for _, key := range v.keys() {
+		var ok bool
+		switch key := key.(type) {
+		case ed25519.PublicKey:
+			ok = alg == "EdDSA" && ed25519.Verify(key, []byte(signed), sig)
+		case *ecdsa.PublicKey:
+			bits := key.Curve.Params().BitSize
+			size := (bits + 7) / 8
+			if ecdsaBits[alg] != bits || len(sig) != 2*size {
+				continue
+			}
+			r := new(big.Int).SetBytes(sig[:size])
+			s := new(big.Int).SetBytes(sig[size:])
+			ok = ecdsa.Verify(key, digest, r, s)
+		case *rsa.PublicKey:
+			switch alg[:2] {
+			case "RS":
+				ok = rsa.VerifyPKCS1v15(key, hash, digest, sig) == nil
+			case "PS":
+				ok = rsa.VerifyPSS(key, hash, digest, sig,
+					&rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+			}
+		}
+		if ok {
+			return nil
+		}
+	}
+	return errors.New("invalid token signature")
+}
+
+func (v *tokenVerifier) verifyClaims(claims map[string]interface{}) error {
+	now := time.Now()
+	exp, ok := claimTime(claims["exp"])
+	if !ok {
+		return errors.New("token without exp")
+	}
+	if now.After(exp.Add(v.Leeway)) {
+		return errors.New("token is expired")
+	}
+	if nbf, ok := claimTime(claims["nbf"]); ok && now.Add(v.Leeway).Before(nbf) {
+		return errors.New("token is not valid yet")
+	}
+
+	if v.Audience != "" {
+		for _, aud := range claimStrings(claims["aud"]) {
+			if aud == v.Audience {
+				return nil
+			}
+		}
+		return errors.Errorf("token is not for audience %q", v.Audience)
+	}
+	return nil
+}
+
+// decodeSegment decode a base64url JSON segment of a token
+func decodeSegment(seg string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// claimTime parse a NumericDate claim
+func claimTime(val interface{}) (time.Time, bool) {
+	num, ok := val.(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	sec, err := num.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(sec*float64(time.Second))), true
+}
+
+// claimStrings parse a claim of a string or a list of strings
+func claimStrings(val interface{}) []string {
+	switch val := val.(type) {
+	case string:
+		return []string{val}
+	case []interface{}:
+		var strs []string
+		for _, v := range val {
+			if s, ok := v.(string); ok {
+				strs = append(strs, s)
+			}
+		}
+		return strs
+	}
+	return nil
+}
+
+// admitToken verify the token of hello, the ids not claimed are removed, and
+// the claims are attached to the hello
+func (c *Client) admitToken(addr net.Addr, h *hello) error {
+	if h.Token == "" {
+		c.Log("no token from %s", addr)
+		return c.rejectAll(addr, h.IDs, RejectToken)
+	}
+	claims, err := c.tokenVerifier.verify(h.Token)
+	if err != nil {
+		c.Log("verify token from %s fail: %s", addr, err)
+		return c.rejectAll(addr, h.IDs, RejectToken)
+	}
+
+	ids := h.IDs[:0]
+	for _, id := range h.IDs {
+		if claims.allow(id) {
+			ids = append(ids, id)
+		} else {
+			c.reject(addr, id, RejectTokenID)
+		}
+	}
+	h.IDs = ids
+	if len(ids) == 0 {
+		return &rejectError{reason: RejectTokenID, backoff: c.backoff()}
+	}
+
+	labels := make(map[string]string, len(h.Labels)+len(claims.labels))
+	for k, v := range h.Labels {
+		labels[k] = v
+	}
+	for k, v := range claims.labels {
+		labels[k] = v
+	}
+	h.Labels, h.claims = labels, claims
+	return nil
+}
@@ -0,0 +1,167 @@
+package pgrpc_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/wweir/pgrpc"
+)
+
+// signToken sign claims into a compact JWT
+func signToken(t *testing.T, alg string, key crypto.Signer, claims map[string]interface{}) string {
+	seg := func(v interface{}) string {
+		data, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := seg(map[string]string{"alg": alg, "typ": "JWT"}) + "." + seg(claims)
+
+	var sig []byte
+	var err error
+	switch key := key.(type) {
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(key, []byte(signed))
+	case *ecdsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signed))
+		r, s, e := ecdsa.Sign(rand.Reader, key, digest[:])
+		sig, err = append(pad32(r.Bytes()), pad32(s.Bytes())...), e
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signed))
+		sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func pad32(b []byte) []byte {
+	return append(make([]byte, 32-len(b)), b...)
+}
+
+func Test_WithTokenAuth(t *testing.T) {
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	dir, err := ioutil.TempDir("", "pgrpc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	revocations := filepath.Join(dir, "revoked")
+	ioutil.WriteFile(revocations, []byte("# revoked\nrevoked-jti\n"), 0600)
+
+	newTokenClient := func(t *testing.T) (*pgrpc.Client, string) {
+		return newClient(t, pgrpc.WithTokenAuth(pgrpc.TokenAuth{
+			Keys:        []crypto.PublicKey{edKey.Public(), ecKey.Public(), rsaKey.Public()},
+			Audience:    "gateway",
+			IDClaim:     "ids",
+			Revocations: revocations,
+		}))
+	}
+	claims := func(kv ...interface{}) map[string]interface{} {
+		m := map[string]interface{}{"sub": "device-1", "aud": []string{"gateway"},
+			"exp": time.Now().Add(time.Hour).Unix(), "ids": []string{"store-*"}, "site": "paris"}
+		for i := 0; i < len(kv); i += 2 {
+			if kv[i+1] == nil {
+				delete(m, kv[i].(string))
+			} else {
+				m[kv[i].(string)] = kv[i+1]
+			}
+		}
+		return m
+	}
+	// listen register ids with tok, labels sent by the server are overridden
+	// by the claims
+	listen := func(t *testing.T, addr, tok string, ids ...string) *pgrpc.Session {
+		t.Helper()
+		sess, err := pgrpc.NewSession(addr, pgrpc.WithToken(tok),
+			pgrpc.WithLabels(map[string]string{"site": "x", "os": "linux"}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, id := range ids {
+			if _, err := sess.Listen(id); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return sess
+	}
+	registered := func(t *testing.T, c *pgrpc.Client, id string) {
+		t.Helper()
+		waitServer(t, c, id)
+		labels := c.Servers(id)[0].Labels
+		if labels["sub"] != "device-1" || labels["site"] != "paris" || labels["os"] != "linux" {
+			t.Errorf("unexpected labels: %v", labels)
+		}
+	}
+	rejected := func(t *testing.T, c *pgrpc.Client, id, reason string) {
+		t.Helper()
+		waitFor(t, "the rejection", func() bool { return c.Stats().Rejected[reason] != 0 })
+		if servers := c.Servers(id); len(servers) != 0 {
+			t.Errorf("%s registered: %+v", id, servers)
+		}
+	}
+
+	for _, tc := range []struct {
+		name   string
+		token  string
+		reject string
+	}{
+		{"EdDSA", signToken(t, "EdDSA", edKey, claims()), ""},
+		{"ES256", signToken(t, "ES256", ecKey, claims()), ""},
+		{"RS256", signToken(t, "RS256", rsaKey, claims()), ""},
+		{"no token", "", pgrpc.RejectToken},
+		{"alg mismatch", signToken(t, "ES384", ecKey, claims()), pgrpc.RejectToken},
+		{"unknown key", signToken(t, "EdDSA", otherKey, claims()), pgrpc.RejectToken},
+		{"alg none", "eyJhbGciOiJub25lIn0.e30.", pgrpc.RejectToken},
+		{"expired", signToken(t, "EdDSA", edKey, claims("exp", time.Now().Add(-time.Minute).Unix())), pgrpc.RejectToken},
+		{"no exp", signToken(t, "EdDSA", edKey, claims("exp", nil)), pgrpc.RejectToken},
+		{"not yet valid", signToken(t, "EdDSA", edKey, claims("nbf", time.Now().Add(time.Hour).Unix())), pgrpc.RejectToken},
+		{"audience", signToken(t, "EdDSA", edKey, claims("aud", "other")), pgrpc.RejectToken},
+		{"no id claim", signToken(t, "EdDSA", edKey, claims("ids", nil)), pgrpc.RejectToken},
+		{"revoked", signToken(t, "EdDSA", edKey, claims("jti", "revoked-jti")), pgrpc.RejectToken},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, addr := newTokenClient(t)
+			defer listen(t, addr, tc.token, "store-1").Close()
+			if tc.reject == "" {
+				registered(t, c, "store-1")
+			} else {
+				rejected(t, c, "store-1", tc.reject)
+			}
+		})
+	}
+
+	// ids out of the claim are rejected, the claimed ones of the same Session
+	// are registered
+	c, addr := newTokenClient(t)
+	tok := signToken(t, "EdDSA", edKey, claims())
+	defer listen(t, addr, tok, "store-1", "web").Close()
+	registered(t, c, "store-1")
+	rejected(t, c, "web", pgrpc.RejectTokenID)
+
+	// the revocation file is reloaded on change, at most every second
+	ioutil.WriteFile(revocations, []byte("device-1\n"), 0600)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(revocations, future, future)
+	time.Sleep(1100 * time.Millisecond)
+	defer listen(t, addr, tok, "store-2").Close()
+	waitFor(t, "the revoked subject", func() bool { return c.Stats().Rejected[pgrpc.RejectToken] != 0 })
+	if servers := c.Servers("store-2"); len(servers) != 0 {
+		t.Errorf("revoked subject registered: %+v", servers)
+	}
+}
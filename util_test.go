@@ -0,0 +1,71 @@
+package pgrpc_test
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/wweir/pgrpc"
+)
+
+// newClient start a client on a random local port, and return its address
+func newClient(t *testing.T, opts ...pgrpc.ClientOpt) (*pgrpc.Client, string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := pgrpc.NewClientWithListener(ln, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, ln.Addr().String()
+}
+
+// waitFor wait until cond is true, or fail the test in 5s
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitServer wait until id is registered on the client
+func waitServer(t *testing.T, c *pgrpc.Client, id string) {
+	t.Helper()
+	waitFor(t, id+" to register", func() bool { return len(c.Servers(id)) != 0 })
+}
+
+// serveEcho echo the conns of ln until it is closed
+func serveEcho(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			io.Copy(conn, conn)
+			conn.Close()
+		}()
+	}
+}
+
+// echo write msg to conn and read it back
+func echo(t *testing.T, conn net.Conn, msg string) {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != msg {
+		t.Fatalf("unexpected echo: %q", buf)
+	}
+	conn.SetDeadline(time.Time{})
+}